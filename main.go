@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/blablacar/go-synapse/synapse"
 	"github.com/ghodss/yaml"
@@ -13,8 +14,11 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -22,28 +26,92 @@ import (
 var Version = "No Version Defined"
 var BuildTime = "1970-01-01_00:00:00_UTC"
 
-func LoadConfig(configPath string) (*synapse.Synapse, error) {
+var envVariableRegex = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)(:-([^}]*))?\}`)
+
+func expandEnv(content []byte) ([]byte, error) {
+	missing := []string{}
+	res := envVariableRegex.ReplaceAllFunc(content, func(match []byte) []byte {
+		groups := envVariableRegex.FindSubmatch(match)
+		value, ok := os.LookupEnv(string(groups[1]))
+		if ok && (value != "" || len(groups[2]) == 0) {
+			return []byte(value)
+		}
+		if len(groups[2]) > 0 {
+			return groups[3]
+		}
+		missing = append(missing, string(groups[1]))
+		return match
+	})
+	if len(missing) > 0 {
+		return nil, errs.WithF(data.WithField("variables", missing), "Unresolved environment variables in configuration")
+	}
+	return res, nil
+}
+
+func LoadConfig(configPath string, envSubstitution bool) (*synapse.Synapse, error) {
 	file, err := ioutil.ReadFile(configPath)
 	if err != nil {
 		return nil, errs.WithEF(err, data.WithField("file", configPath), "Failed to read configuration file")
 	}
 
+	if envSubstitution {
+		file, err = expandEnv(file)
+		if err != nil {
+			return nil, errs.WithEF(err, data.WithField("file", configPath), "Failed to substitute environment variables")
+		}
+	}
+
 	conf := &synapse.Synapse{}
-	err = yaml.Unmarshal(file, conf)
-	if err != nil {
-		return nil, errs.WithEF(err, data.WithField("file", configPath), "Invalid configuration format")
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".json":
+		if err := json.Unmarshal(file, conf); err != nil {
+			return nil, errs.WithEF(err, data.WithField("file", configPath).WithField("format", "json"), "Invalid configuration format")
+		}
+	default:
+		if err := yaml.Unmarshal(file, conf); err != nil {
+			return nil, errs.WithEF(err, data.WithField("file", configPath).WithField("format", "yaml"), "Invalid configuration format")
+		}
 	}
 
+	if err := conf.Validate(); err != nil {
+		return nil, errs.WithEF(err, data.WithField("file", configPath), "Invalid configuration")
+	}
 	return conf, nil
 }
 
-func waitForSignal() {
+func waitForSignal(s *synapse.Synapse, configPath string, envSubstitution bool) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
-	<-sigs
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		logs.Info("Reload signal received")
+		conf, err := LoadConfig(configPath, envSubstitution)
+		if err != nil {
+			logs.WithE(err).Error("Failed to load configuration. Keeping current one")
+			continue
+		}
+		if err := s.Reload(conf); err != nil {
+			logs.WithE(err).Error("Failed to reload configuration. Keeping current one")
+		}
+	}
 	logs.Debug("Stop signal received")
 }
 
+// a dry run stops once routers got all services discovered once, or on stop signal
+func waitForFirstRound(s *synapse.Synapse) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-s.FirstRoundDone():
+		logs.Info("Dry run done with first report of all services")
+	case <-sigs:
+		logs.Debug("Stop signal received")
+	}
+}
+
 //func trace() {
 //	// We don't know how big the traces are, so grow a few times if they don't fit. Start large, though.
 //	n := 10000
@@ -64,7 +132,7 @@ func waitForSignal() {
 //}
 
 func sigQuitThreadDump() {
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	go func() {
 		for range sigChan {
 			stacktrace := make([]byte, 2<<20)
@@ -84,9 +152,11 @@ func main() {
 	var logLevel string
 	var version bool
 	var oneshot bool
+	var envSubstitution bool
+	var dryRun bool
 
 	rootCmd := &cobra.Command{
-		Use: "synapse config.yml",
+		Use: "synapse config.yml|config.json",
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
 			if version {
 				fmt.Println("Synapse")
@@ -107,11 +177,15 @@ func main() {
 			if len(args) != 1 {
 				logs.Fatal("Synapse require a configuration file as argument")
 			}
-			synapse, err := LoadConfig(args[0])
+			synapse, err := LoadConfig(args[0], envSubstitution)
 			if err != nil {
 				logs.WithE(err).Fatal("Cannot start, failed to load configuration")
 			}
 
+			if dryRun {
+				synapse.DryRun = true
+			}
+
 			if err := synapse.Init(Version, BuildTime, logLevel != ""); err != nil {
 				logs.WithE(err).Fatal("Failed to init synapse")
 			}
@@ -119,13 +193,22 @@ func main() {
 			if err := synapse.Start(oneshot); err != nil {
 				logs.WithE(err).Fatal("Failed to start synapse")
 			}
-			waitForSignal()
+			if synapse.DryRun {
+				waitForFirstRound(synapse)
+			} else {
+				waitForSignal(synapse, args[0], envSubstitution)
+			}
 			synapse.Stop()
+			if synapse.DryRun && synapse.DryRunChanged() {
+				os.Exit(2)
+			}
 		},
 	}
 
 	rootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "L", "", "Set log level")
 	rootCmd.PersistentFlags().BoolVarP(&version, "version", "V", false, "Display version")
+	rootCmd.PersistentFlags().BoolVarP(&envSubstitution, "env", "E", false, "Substitute ${VAR} and ${VAR:-default} in configuration with environment variables")
+	rootCmd.PersistentFlags().BoolVarP(&dryRun, "dry-run", "D", false, "Log configuration diffs, reloads and socket commands instead of applying them")
 	//rootCmd.PersistentFlags().BoolVarP(&oneshot, "oneshot", "O", false, "run watchers/router only once and exit")
 
 	if err := rootCmd.Execute(); err != nil {
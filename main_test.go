@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("SYNAPSE_TEST_SET", "zk1:2181")
+	os.Setenv("SYNAPSE_TEST_EMPTY", "")
+	os.Unsetenv("SYNAPSE_TEST_UNSET")
+	defer os.Unsetenv("SYNAPSE_TEST_SET")
+	defer os.Unsetenv("SYNAPSE_TEST_EMPTY")
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+		missing  string
+	}{
+		{name: "set", content: "hosts: [${SYNAPSE_TEST_SET}]", expected: "hosts: [zk1:2181]"},
+		{name: "set with default", content: "hosts: [${SYNAPSE_TEST_SET:-zk2:2181}]", expected: "hosts: [zk1:2181]"},
+		{name: "unset with default", content: "hosts: [${SYNAPSE_TEST_UNSET:-zk2:2181}]", expected: "hosts: [zk2:2181]"},
+		{name: "empty with default", content: "hosts: [${SYNAPSE_TEST_EMPTY:-zk2:2181}]", expected: "hosts: [zk2:2181]"},
+		{name: "empty without default", content: "path: '${SYNAPSE_TEST_EMPTY}'", expected: "path: ''"},
+		{name: "empty default", content: "path: '${SYNAPSE_TEST_UNSET:-}'", expected: "path: ''"},
+		{name: "unset without default", content: "hosts: [${SYNAPSE_TEST_UNSET}]", missing: "SYNAPSE_TEST_UNSET"},
+		{name: "literal dollar", content: "password: pa$$word$ $HOME {x}", expected: "password: pa$$word$ $HOME {x}"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := expandEnv([]byte(test.content))
+			if test.missing != "" {
+				if err == nil || !strings.Contains(err.Error(), test.missing) {
+					t.Fatalf("Expected error naming %s, got %v", test.missing, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if string(res) != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package synapse
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+const diffContextLines = 3
+
+// minimal line based unified diff, enough to show configuration changes in logs
+func unifiedDiff(oldName string, newName string, old []byte, new []byte) string {
+	a := strings.SplitAfter(string(old), "\n")
+	b := strings.SplitAfter(string(new), "\n")
+	if len(a) > 0 && a[len(a)-1] == "" {
+		a = a[:len(a)-1]
+	}
+	if len(b) > 0 && b[len(b)-1] == "" {
+		b = b[:len(b)-1]
+	}
+
+	// common prefix and suffix are skipped to keep the lcs table small
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	if prefix == len(a) && prefix == len(b) {
+		return ""
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	lines := []line{}
+	for _, l := range a[:prefix] {
+		lines = append(lines, line{' ', l})
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	lcs := make([][]int, len(midA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(midB)+1)
+	}
+	for i := len(midA) - 1; i >= 0; i-- {
+		for j := len(midB) - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(midA) || j < len(midB) {
+		switch {
+		case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+			lines = append(lines, line{' ', midA[i]})
+			i++
+			j++
+		case j == len(midB) || (i < len(midA) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', midA[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', midB[j]})
+			j++
+		}
+	}
+	for _, l := range a[len(a)-suffix:] {
+		lines = append(lines, line{' ', l})
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("--- " + oldName + "\n+++ " + newName + "\n")
+	oldLine, newLine := 1, 1
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			oldLine++
+			newLine++
+			start++
+			continue
+		}
+
+		// extend the hunk while changes are separated by less than two contexts
+		from := start - diffContextLines
+		if from < 0 {
+			from = 0
+		}
+		end := start
+		for k := start; k < len(lines) && k-end <= 2*diffContextLines; k++ {
+			if lines[k].op != ' ' {
+				end = k
+			}
+		}
+		to := end + diffContextLines + 1
+		if to > len(lines) {
+			to = len(lines)
+		}
+
+		hunkOld, hunkNew := oldLine-(start-from), newLine-(start-from)
+		oldCount, newCount := 0, 0
+		for _, l := range lines[from:to] {
+			if l.op != '+' {
+				oldCount++
+			}
+			if l.op != '-' {
+				newCount++
+			}
+		}
+		buffer.WriteString("@@ -" + strconv.Itoa(hunkOld) + "," + strconv.Itoa(oldCount) +
+			" +" + strconv.Itoa(hunkNew) + "," + strconv.Itoa(newCount) + " @@\n")
+		for _, l := range lines[from:to] {
+			buffer.WriteByte(l.op)
+			buffer.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				buffer.WriteString("\n")
+			}
+		}
+
+		for _, l := range lines[start:to] {
+			if l.op != '+' {
+				oldLine++
+			}
+			if l.op != '-' {
+				newLine++
+			}
+		}
+		start = to
+	}
+	return buffer.String()
+}
@@ -0,0 +1,53 @@
+package synapse
+
+import (
+	"bytes"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// run a command and kill it with all its children if it does not end before the timeout
+func execCommand(cmd []string, env []string, timeoutInMilli int) error {
+	_, err := execCommandOutput(cmd, env, timeoutInMilli)
+	return err
+}
+
+// standard output of a successful command
+func execCommandOutput(cmd []string, env []string, timeoutInMilli int) ([]byte, error) {
+	fields := data.WithField("command", strings.Join(cmd, " "))
+	command := exec.Command(cmd[0], cmd[1:]...)
+	// stdout and stderr are copied by different goroutines, so each gets its own buffer
+	var stdout, stderr bytes.Buffer
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	command.Env = env
+	setProcessGroup(command)
+
+	if err := command.Start(); err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to start command")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, errs.WithEF(err, fields.WithField("output", stdout.String()+stderr.String()), "Command failed")
+		}
+		return stdout.Bytes(), nil
+	case <-time.After(time.Duration(timeoutInMilli) * time.Millisecond):
+		fields = fields.WithField("timeout", timeoutInMilli)
+		logs.WithF(fields).Warn("Command timeout. Killing it")
+		if err := killProcessGroup(command); err != nil {
+			logs.WithEF(err, fields).Error("Failed to kill command")
+		}
+		return nil, errs.WithF(fields, "Command timeout")
+	}
+}
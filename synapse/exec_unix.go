@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package synapse
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(command *exec.Cmd) {
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(command *exec.Cmd) error {
+	return syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,12 @@
+package synapse
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(command *exec.Cmd) {
+}
+
+func killProcessGroup(command *exec.Cmd) error {
+	return command.Process.Kill()
+}
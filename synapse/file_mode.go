@@ -0,0 +1,31 @@
+package synapse
+
+import (
+	"encoding/json"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"os"
+	"strconv"
+)
+
+type FileMode os.FileMode
+
+func (m *FileMode) UnmarshalJSON(d []byte) error {
+	var s string
+	if err := json.Unmarshal(d, &s); err != nil {
+		return errs.WithEF(err, data.WithField("value", string(d)), "File mode must be an octal string")
+	}
+
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("value", s), "Invalid octal file mode")
+	}
+	if mode > uint64(os.ModePerm) {
+		return errs.WithF(data.WithField("value", s), "File mode must be within 0001-0777")
+	}
+	if mode == 0 {
+		return errs.WithF(data.WithField("value", s), "File mode 0000 would make the file unreadable")
+	}
+	*m = FileMode(mode)
+	return nil
+}
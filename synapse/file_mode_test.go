@@ -0,0 +1,51 @@
+package synapse
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		mode  FileMode
+		err   bool
+	}{
+		{name: "octal", value: `"0640"`, mode: 0640},
+		{name: "without leading zero", value: `"600"`, mode: 0600},
+		{name: "zero", value: `"0000"`, err: true},
+		{name: "not octal", value: `"0800"`, err: true},
+		{name: "too large", value: `"1777"`, err: true},
+		{name: "number", value: `644`, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mode FileMode
+			err := json.Unmarshal([]byte(test.value), &mode)
+			if (err != nil) != test.err {
+				t.Fatalf("Expected error %t, got %v", test.err, err)
+			}
+			if mode != test.mode {
+				t.Errorf("Expected mode %o, got %o", test.mode, mode)
+			}
+		})
+	}
+}
+
+func TestFileModeDefaultOnlyWhenAbsent(t *testing.T) {
+	hap := HaProxyClient{}
+	if err := json.Unmarshal([]byte(`{"stateFileMode":"0600"}`), &hap); err != nil {
+		t.Fatalf("Failed to unmarshal haproxy client: %s", err)
+	}
+	if err := json.Unmarshal([]byte(`{"configFileMode":"0000"}`), &hap); err == nil {
+		t.Errorf("Expected configFileMode 0000 to be rejected")
+	}
+	if err := hap.Init(); err != nil {
+		t.Fatalf("Failed to init haproxy client: %s", err)
+	}
+	if hap.ConfigFileMode != 0644 || hap.StateFileMode != 0600 {
+		t.Errorf("Expected modes 644 and 600, got %o and %o", hap.ConfigFileMode, hap.StateFileMode)
+	}
+}
@@ -3,15 +3,19 @@ package synapse
 import (
 	"bufio"
 	"bytes"
-	"github.com/blablacar/go-nerve/nerve"
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
+	"github.com/prometheus/client_golang/prometheus"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 )
@@ -25,6 +29,11 @@ defaults
 {{- range .Defaults}}
   {{.}}{{end}}
 
+{{range $key, $element := .Resolvers}}
+resolvers {{$key}}
+{{- range $element}}
+  {{.}}{{end}}
+{{end}}
 {{range $key, $element := .Listen}}
 listen {{$key}}
 {{- range $element}}
@@ -43,29 +52,65 @@ backend {{$key}}
 
 `
 
+const SOCKET_COMMAND_BATCH = "batch"
+const SOCKET_COMMAND_SINGLE = "single"
+
 type HaProxyConfig struct {
-	Global   []string
-	Defaults []string
-	Listen   map[string][]string
-	Frontend map[string][]string
-	Backend  map[string][]string
+	Global    []string
+	Defaults  []string
+	Resolvers map[string][]string
+	Listen    map[string][]string
+	Frontend  map[string][]string
+	Backend   map[string][]string
 }
 
 type HaProxyClient struct {
 	HaProxyConfig
 	ConfigPath               string
+	ConfigFileMode           FileMode
 	ReloadCommand            []string
+	PreReloadCommand         []string
+	PostReloadCommand        []string
 	ReloadMinIntervalInMilli int
 	ReloadTimeoutInMilli     int
+	PidFile                  string
 	StatePath                string
-
-	reloadMutex sync.Mutex
-	socketPath  string
-	socketRegex *regexp.Regexp
-	weightRegex *regexp.Regexp
-	lastReload  time.Time
-	template    *template.Template
-	fields      data.Fields
+	StateFileMode            FileMode
+	StateFileTtlInMilli      *int
+	GoodStatePath            string
+	GoodStateFileTtlInMilli  *int
+	CheckConfig              bool
+	CheckCommand             []string
+	SocketAddress            string // single socket form, folded into SocketAddresses by Init
+	SocketAddresses          []string
+	SocketCommandMode        string
+	DrainOnShutdown          bool
+	DrainTimeoutInMilli      int
+	DoWrites                 *bool
+	DoReloads                *bool
+	DoSocket                 *bool
+	VerifyListenAfterReload  bool
+	ManagedRegionOnly        bool
+	RollbackOnListenFailure  bool
+	MaxReloadFailures        int
+	RemoveStateOnShutdown    bool
+
+	reloadMutex        sync.Mutex
+	reloads            prometheus.Counter
+	socketCommands     prometheus.Counter
+	configWrites       prometheus.Counter
+	listenFailures     prometheus.Counter
+	reloadsOnHoldGauge prometheus.Gauge
+	reloadFailures     int
+	reloadsOnHold      bool
+	socketRegex        *regexp.Regexp
+	weightRegex        *regexp.Regexp
+	serverRegex        *regexp.Regexp
+	lastReload         time.Time
+	template           *template.Template
+	fields             data.Fields
+	dryRun             bool
+	dryRunChanges      int32
 }
 
 func (hap *HaProxyClient) Init() error {
@@ -81,6 +126,23 @@ func (hap *HaProxyClient) Init() error {
 		hap.Backend = make(map[string][]string)
 	}
 
+	if hap.ConfigFileMode == 0 {
+		hap.ConfigFileMode = 0644
+	}
+
+	if hap.StateFileMode == 0 {
+		hap.StateFileMode = 0644
+	}
+
+	if hap.StateFileTtlInMilli == nil {
+		ttl := 2000
+		hap.StateFileTtlInMilli = &ttl
+	}
+
+	if hap.GoodStateFileTtlInMilli == nil {
+		hap.GoodStateFileTtlInMilli = hap.StateFileTtlInMilli
+	}
+
 	if hap.ReloadMinIntervalInMilli == 0 {
 		hap.ReloadMinIntervalInMilli = 500
 	}
@@ -89,11 +151,41 @@ func (hap *HaProxyClient) Init() error {
 		hap.ReloadTimeoutInMilli = 1000
 	}
 
+	if hap.SocketCommandMode == "" {
+		hap.SocketCommandMode = SOCKET_COMMAND_BATCH
+	}
+
+	if hap.DrainOnShutdown && hap.DrainTimeoutInMilli == 0 {
+		hap.DrainTimeoutInMilli = 10000
+	}
+
+	enabled := true
+	if hap.DoWrites == nil {
+		hap.DoWrites = &enabled
+	}
+	if hap.DoReloads == nil {
+		hap.DoReloads = &enabled
+	}
+	if hap.DoSocket == nil {
+		hap.DoSocket = &enabled
+	}
+
+	if (hap.CheckConfig || hap.MaxReloadFailures > 0) && len(hap.CheckCommand) == 0 {
+		hap.CheckCommand = []string{"haproxy", "-c", "-f"}
+	}
+
 	hap.socketRegex = regexp.MustCompile(`stats[\s]+socket[\s]+(\S+)`)
 	hap.weightRegex = regexp.MustCompile(`server[\s]+([\S]+).*weight[\s]+([\d]+)`)
+	hap.serverRegex = regexp.MustCompile(`^server[\s]+([\S]+)`)
 
-	hap.socketPath = hap.findSocketPath()
-	if hap.socketPath == "" {
+	if hap.SocketAddress != "" {
+		hap.SocketAddresses = append(hap.SocketAddresses, hap.SocketAddress)
+		hap.SocketAddress = ""
+	}
+	if len(hap.SocketAddresses) == 0 {
+		hap.SocketAddresses = hap.findSocketPaths()
+	}
+	if len(hap.SocketAddresses) == 0 {
 		logs.WithF(hap.fields).Warn("No socketPath file specified. Will update by reload only")
 	}
 
@@ -106,113 +198,468 @@ func (hap *HaProxyClient) Init() error {
 	return nil
 }
 
-func (hap *HaProxyClient) findSocketPath() string {
+func (hap *HaProxyClient) validate(fields data.Fields) []error {
+	problems := []error{}
+	if hap.ConfigPath == "" {
+		problems = append(problems, errs.WithF(fields, "ConfigPath is required for haproxy router"))
+	}
+	if len(hap.ReloadCommand) == 0 {
+		problems = append(problems, errs.WithF(fields, "ReloadCommand is required for haproxy router"))
+	}
+	if hap.SocketCommandMode != "" && hap.SocketCommandMode != SOCKET_COMMAND_BATCH && hap.SocketCommandMode != SOCKET_COMMAND_SINGLE {
+		problems = append(problems, errs.WithF(fields.WithField("mode", hap.SocketCommandMode), "Unsupported socket command mode"))
+	}
+	return problems
+}
+
+// all 'stats socket' of global, there is one per process with nbproc
+func (hap *HaProxyClient) findSocketPaths() []string {
+	paths := []string{}
 	for _, str := range hap.Global {
 		res := hap.socketRegex.FindStringSubmatch(str)
 		if len(res) > 1 {
-			return res[1]
+			paths = append(paths, res[1])
 		}
 	}
-	return ""
+	return paths
 }
 
 func (hap *HaProxyClient) Reload() error {
+	return hap.reload(true)
+}
+
+// without write, haproxy is reloaded with the configuration file as it is
+func (hap *HaProxyClient) reload(write bool) error {
 	hap.reloadMutex.Lock()
 	defer hap.reloadMutex.Unlock()
 
-	if err := hap.writeConfig(); err != nil {
-		return errs.WithEF(err, hap.fields, "Failed to write haproxy configuration")
-	}
-
-	logs.WithF(hap.fields).Debug("Reloading haproxy")
-	env := append(os.Environ(), "HAP_CONFIG="+hap.ConfigPath)
-
 	waitDuration := hap.lastReload.Add(time.Duration(hap.ReloadMinIntervalInMilli) * time.Millisecond).Sub(time.Now())
 	if waitDuration > 0 {
-		logs.WithF(hap.fields.WithField("wait", waitDuration)).Debug("Reloading too fast")
+		logs.WithF(hap.fields.WithField("wait", waitDuration)).Info("Reloading too fast. Throttling reload")
 		time.Sleep(waitDuration)
 	}
 	defer func() {
 		hap.lastReload = time.Now()
 	}()
-	if err := nerve.ExecCommandFull(hap.ReloadCommand, env, hap.ReloadTimeoutInMilli); err != nil {
+
+	if hap.reloadsOnHold && !write {
+		return errs.WithF(hap.fields, "Reloads are on hold after too many failures. Waiting for a valid configuration or an api reload")
+	}
+
+	var templated []byte
+	if write {
+		var err error
+		templated, err = hap.templateConfig()
+		if err != nil {
+			return errs.WithEF(err, hap.fields, "Failed to template haproxy configuration")
+		}
+
+		if hap.CheckConfig || hap.reloadsOnHold {
+			if err := hap.checkConfig(templated); err != nil {
+				return errs.WithEF(err, hap.fields, "Invalid haproxy configuration. Keeping previous one")
+			}
+		}
+		if hap.reloadsOnHold {
+			// failures are kept, so a new one holds reloads again
+			logs.WithF(hap.fields).Info("Configuration check passed. Resuming reloads")
+			hap.reloadsOnHold = false
+			hap.reloadsOnHoldGauge.Set(0)
+		}
+	}
+
+	env := append(os.Environ(), "HAP_CONFIG="+hap.ConfigPath)
+	if len(hap.PreReloadCommand) > 0 && !hap.dryRun {
+		logs.WithF(hap.fields).Debug("Running pre reload command")
+		if err := execCommand(hap.PreReloadCommand, env, hap.ReloadTimeoutInMilli); err != nil {
+			return errs.WithEF(err, hap.fields, "Pre reload command failed. Keeping previous configuration")
+		}
+	}
+
+	var previous []byte
+	if write && hap.VerifyListenAfterReload && hap.RollbackOnListenFailure && !hap.dryRun {
+		content, err := ioutil.ReadFile(hap.ConfigPath)
+		if err != nil && !os.IsNotExist(err) {
+			logs.WithEF(err, hap.fields).Warn("Failed to read current configuration. Rollback will not be possible")
+		}
+		previous = content
+	}
+
+	if write {
+		if err := hap.writeFile(templated); err != nil {
+			return errs.WithEF(err, hap.fields, "Failed to write haproxy configuration")
+		}
+	}
+
+	if hap.dryRun {
+		logs.WithF(hap.fields.WithField("command", hap.reloadCommand())).Info("Dry run. Would reload haproxy")
+		atomic.AddInt32(&hap.dryRunChanges, 1)
+		return nil
+	}
+
+	logs.WithF(hap.fields).Debug("Reloading haproxy")
+	if err := execCommand(hap.reloadCommand(), env, hap.ReloadTimeoutInMilli); err != nil {
+		hap.reloadFailed()
 		return errs.WithEF(err, hap.fields, "Failed to reload haproxy")
 	}
+	hap.reloadFailures = 0
+	hap.reloads.Inc()
+
+	if hap.VerifyListenAfterReload {
+		if err := hap.verifyListen(); err != nil {
+			hap.listenFailures.Inc()
+			if len(previous) > 0 {
+				if rollbackErr := hap.rollback(previous, env); rollbackErr != nil {
+					logs.WithEF(rollbackErr, hap.fields).Error("Failed to rollback haproxy configuration")
+				}
+			}
+			return err
+		}
+	}
+
+	if len(hap.PostReloadCommand) > 0 {
+		logs.WithF(hap.fields).Debug("Running post reload command")
+		if err := execCommand(hap.PostReloadCommand, env, hap.ReloadTimeoutInMilli); err != nil {
+			logs.WithEF(err, hap.fields).Warn("Post reload command failed")
+		}
+	}
 	return nil
 }
 
-func (hap *HaProxyClient) SocketUpdate() error {
-	if hap.socketPath == "" {
-		return errs.WithF(hap.fields, "No socket file specified. Cannot update")
+// count consecutive reload failures, and stop reloading once too many of them failed
+func (hap *HaProxyClient) reloadFailed() {
+	hap.reloadFailures++
+	if hap.MaxReloadFailures <= 0 || hap.reloadFailures < hap.MaxReloadFailures || hap.reloadsOnHold {
+		return
 	}
-	logs.WithF(hap.fields).Debug("Updating haproxy by socket")
+	logs.WithF(hap.fields.WithField("failures", hap.reloadFailures)).
+		Error("Too many consecutive haproxy reload failures. Holding reloads until configuration check passes or api reload")
+	hap.reloadsOnHold = true
+	hap.reloadsOnHoldGauge.Set(1)
+}
 
-	if err := hap.writeConfig(); err != nil { // just to stay in sync
-		logs.WithEF(err, hap.fields).Warn("Failed to write configuration file")
+func (hap *HaProxyClient) releaseReloadHold() {
+	hap.reloadMutex.Lock()
+	defer hap.reloadMutex.Unlock()
+	hap.reloadFailures = 0
+	hap.reloadsOnHold = false
+	hap.reloadsOnHoldGauge.Set(0)
+}
+
+func (hap *HaProxyClient) reloadCommand() []string {
+	if hap.PidFile == "" {
+		return hap.ReloadCommand
 	}
 
-	conn, err := net.Dial("unix", hap.socketPath)
+	content, err := ioutil.ReadFile(hap.PidFile)
 	if err != nil {
-		return errs.WithEF(err, hap.fields.WithField("socket", hap.socketPath), "Failed to connect to haproxy socket")
+		logs.WithEF(err, hap.fields.WithField("pidfile", hap.PidFile)).Warn("Cannot read haproxy pid file. Reloading without -sf")
+		return hap.ReloadCommand
 	}
-	defer conn.Close()
+	pids := strings.Fields(string(content))
+	if len(pids) == 0 {
+		logs.WithF(hap.fields.WithField("pidfile", hap.PidFile)).Warn("Haproxy pid file is empty. Reloading without -sf")
+		return hap.ReloadCommand
+	}
+	for _, pid := range pids {
+		if _, err := strconv.Atoi(pid); err != nil {
+			logs.WithEF(err, hap.fields.WithField("pidfile", hap.PidFile)).Warn("Invalid pid in haproxy pid file. Reloading without -sf")
+			return hap.ReloadCommand
+		}
+	}
+
+	command := append([]string{}, hap.ReloadCommand...)
+	command = append(command, "-sf")
+	return append(command, pids...)
+}
+
+// socket can be a unix path or a tcp address, as url (tcp://, unix://) or in haproxy bind format (ipv4@, ipv6@, unix@)
+func (hap *HaProxyClient) dialSocket(socket string) (net.Conn, error) {
+	network, address := "unix", socket
+	switch {
+	case strings.HasPrefix(address, "tcp://"):
+		network, address = "tcp", strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "unix://"):
+		address = strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "ipv4@"):
+		network, address = "tcp4", strings.TrimPrefix(address, "ipv4@")
+	case strings.HasPrefix(address, "ipv6@"):
+		network, address = "tcp6", strings.TrimPrefix(address, "ipv6@")
+	case strings.HasPrefix(address, "unix@"):
+		address = strings.TrimPrefix(address, "unix@")
+	case !strings.Contains(address, "/") && strings.Contains(address, ":"):
+		network = "tcp"
+	}
+	return net.DialTimeout(network, address, time.Duration(hap.ReloadTimeoutInMilli)*time.Millisecond)
+}
+
+func (hap *HaProxyClient) SocketUpdate() error {
+	return hap.socketUpdate(true)
+}
 
-	i := 0
-	b := bytes.Buffer{}
+// set weights of all servers, then run stateCommands
+func (hap *HaProxyClient) socketUpdate(write bool, stateCommands ...string) error {
+	if len(hap.SocketAddresses) == 0 {
+		return errs.WithF(hap.fields, "No socket file specified. Cannot update")
+	}
+	logs.WithF(hap.fields).Debug("Updating haproxy by socket")
+
+	if write {
+		if err := hap.writeConfig(); err != nil { // just to stay in sync
+			logs.WithEF(err, hap.fields).Warn("Failed to write configuration file")
+		}
+	}
+
+	commands := []string{}
 	for name, servers := range hap.Backend {
 		for _, server := range servers {
 			res := hap.weightRegex.FindStringSubmatch(server)
 			if len(res) == 3 {
-				i++
-				b.WriteString("set weight " + name + "/" + res[1] + " " + res[2] + "\n")
+				commands = append(commands, "set weight "+name+"/"+res[1]+" "+res[2])
 			}
 		}
 	}
+	commands = append(commands, stateCommands...)
 
-	if b.Len() == 0 {
+	if len(commands) == 0 {
 		logs.WithF(hap.fields).Debug("Nothing to update by socket. No weight set")
 		return nil
 	}
+	return hap.runSocketCommands(commands)
+}
+
+// disable all servers so haproxy stops sending new connections, and return how long to wait for current ones
+func (hap *HaProxyClient) drain() (time.Duration, error) {
+	if !hap.DrainOnShutdown {
+		return 0, nil
+	}
+	if hap.dryRun {
+		// nothing was applied to drain, and exiting is not a change
+		logs.WithF(hap.fields).Info("Dry run. Not draining haproxy servers")
+		return 0, nil
+	}
+	if len(hap.SocketAddresses) == 0 {
+		return 0, errs.WithF(hap.fields, "No socket file specified. Cannot drain")
+	}
+
+	commands := []string{}
+	for name, servers := range hap.Backend {
+		for _, server := range servers {
+			res := hap.serverRegex.FindStringSubmatch(server)
+			if len(res) == 2 {
+				commands = append(commands, "disable server "+name+"/"+res[1])
+			}
+		}
+	}
+	if len(commands) == 0 {
+		return 0, nil
+	}
+
+	logs.WithF(hap.fields).Debug("Draining haproxy servers")
+	if err := hap.runSocketCommands(commands); err != nil {
+		return 0, err
+	}
+	return time.Duration(hap.DrainTimeoutInMilli) * time.Millisecond, nil
+}
+
+func (hap *HaProxyClient) runSocketCommands(commands []string) error {
+	if hap.dryRun {
+		logs.WithF(hap.fields.WithField("commands", commands)).Info("Dry run. Would run haproxy socket commands")
+		atomic.AddInt32(&hap.dryRunChanges, 1)
+		return nil
+	}
 
-	commands := b.Bytes()
+	// each socket only reaches its own haproxy process, so commands are sent to all of them
+	failures := []error{}
+	for _, socket := range hap.SocketAddresses {
+		if err := hap.runSocketCommandsOn(socket, commands); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	if len(failures) > 0 {
+		return errs.WithF(hap.fields.WithField("failed", len(failures)), "Failed to run commands on haproxy sockets").WithErrs(failures...)
+	}
+	return nil
+}
+
+func (hap *HaProxyClient) runSocketCommandsOn(socket string, commands []string) error {
+	if hap.SocketCommandMode == SOCKET_COMMAND_SINGLE {
+		for _, command := range commands {
+			if err := hap.runSocketCommand(socket, command); err != nil {
+				return err
+			}
+			hap.socketCommands.Inc()
+		}
+		return nil
+	}
 
-	logs.WithF(hap.fields.WithField("command", string(commands))).Trace("Running command on hap socket")
-	count, err := conn.Write(commands)
-	if count != len(commands) || err != nil {
-		return errs.WithEF(err, hap.fields.
-			WithField("written", count).
-			WithField("len", len(commands)).
-			WithField("command", string(commands)), "Failed to write command to haproxy")
+	// haproxy runs ';' separated commands of a single line one after the other
+	if err := hap.runSocketCommand(socket, strings.Join(commands, "; ")); err != nil {
+		return err
 	}
+	hap.socketCommands.Add(float64(len(commands)))
+	return nil
+}
 
-	buff := bufio.NewReader(conn)
-	line, prefix, err := buff.ReadLine()
-	if err != nil || prefix {
-		return errs.WithEF(err, hap.fields.WithField("line-too-long", prefix), "Failed to read hap socket response")
+// run one line on a new connection. Successful commands only output empty lines
+func (hap *HaProxyClient) runSocketCommand(socket string, command string) error {
+	conn, err := hap.dialSocket(socket)
+	if err != nil {
+		return errs.WithEF(err, hap.fields.WithField("socket", socket), "Failed to connect to haproxy socket")
 	}
-	if string(line) != "" {
-		return errs.WithF(hap.fields.WithField("response", string(line)), "Bad response for haproxy socket command")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(hap.ReloadTimeoutInMilli) * time.Millisecond))
+
+	logs.WithF(hap.fields.WithField("command", command)).Trace("Running command on hap socket")
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return errs.WithEF(err, hap.fields.WithField("command", command), "Failed to write command to haproxy")
 	}
 
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return errs.WithEF(err, hap.fields.WithField("command", command), "Failed to read hap socket response")
+	}
+	if strings.TrimSpace(string(response)) != "" {
+		return errs.WithF(hap.fields.WithField("command", command).WithField("response", string(response)), "Bad response for haproxy socket command")
+	}
 	return nil
 }
 
 func (hap *HaProxyClient) writeConfig() error {
+	templated, err := hap.templateConfig()
+	if err != nil {
+		return err
+	}
+	return hap.writeFile(templated)
+}
+
+func (hap *HaProxyClient) dryRunChanged() bool {
+	return atomic.LoadInt32(&hap.dryRunChanges) > 0
+}
+
+func (hap *HaProxyClient) templateConfig() ([]byte, error) {
 	var b bytes.Buffer
 	writer := bufio.NewWriter(&b)
 	if err := hap.template.Execute(writer, hap); err != nil {
-		return errs.WithEF(err, hap.fields, "Failed to temlate haproxy configuration file")
+		return nil, errs.WithEF(err, hap.fields, "Failed to temlate haproxy configuration file")
 	}
 	if err := writer.Flush(); err != nil {
-		return errs.WithEF(err, hap.fields, "Failed to flush buffer")
+		return nil, errs.WithEF(err, hap.fields, "Failed to flush buffer")
 	}
 
 	templated := b.Bytes()
+	if hap.ManagedRegionOnly {
+		merged, err := hap.mergeManagedRegion(templated)
+		if err != nil {
+			return nil, err
+		}
+		templated = merged
+	}
 	if logs.IsTraceEnabled() {
 		logs.WithF(hap.fields.WithField("templated", string(templated))).Trace("Templated configuration file")
 	}
-	if err := ioutil.WriteFile(hap.ConfigPath, templated, 0644); err != nil {
+	return templated, nil
+}
+
+const managedRegionBegin = "# BEGIN go-synapse"
+const managedRegionEnd = "# END go-synapse"
+
+// put templated config between markers of the current file, keeping lines added by hand around them.
+// Without current file or markers, the whole file is generated with markers
+func (hap *HaProxyClient) mergeManagedRegion(templated []byte) ([]byte, error) {
+	region := managedRegionBegin + "\n" + string(templated) + managedRegionEnd + "\n"
+
+	current, err := ioutil.ReadFile(hap.ConfigPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errs.WithEF(err, hap.fields, "Failed to read current configuration file")
+	}
+	content := string(current)
+	begin := strings.Index(content, managedRegionBegin)
+	end := -1
+	if begin >= 0 {
+		end = strings.Index(content[begin:], managedRegionEnd)
+	}
+	if end < 0 {
+		if len(current) > 0 {
+			logs.WithF(hap.fields).Warn("No managed region markers in configuration file. Generating whole file")
+		}
+		return []byte(region), nil
+	}
+	end += begin + len(managedRegionEnd)
+	if end < len(content) && content[end] == '\n' {
+		end++
+	}
+	return []byte(content[:begin] + region + content[end:]), nil
+}
+
+func (hap *HaProxyClient) checkConfig(templated []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(hap.ConfigPath), "."+filepath.Base(hap.ConfigPath)+".check")
+	if err != nil {
+		return errs.WithEF(err, hap.fields, "Failed to create temporary configuration file")
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(templated); err != nil {
+		file.Close()
+		return errs.WithEF(err, hap.fields.WithField("file", file.Name()), "Failed to write temporary configuration file")
+	}
+	if err := file.Close(); err != nil {
+		return errs.WithEF(err, hap.fields.WithField("file", file.Name()), "Failed to close temporary configuration file")
+	}
+
+	logs.WithF(hap.fields).Debug("Checking haproxy configuration")
+	command := append(append([]string{}, hap.CheckCommand...), file.Name())
+	if err := execCommand(command, os.Environ(), hap.ReloadTimeoutInMilli); err != nil {
+		return errs.WithEF(err, hap.fields, "Haproxy configuration check failed")
+	}
+	return nil
+}
+
+func (hap *HaProxyClient) writeFile(templated []byte) error {
+	if hap.dryRun {
+		current, err := ioutil.ReadFile(hap.ConfigPath)
+		if err != nil && !os.IsNotExist(err) {
+			return errs.WithEF(err, hap.fields, "Failed to read current configuration file")
+		}
+		if diff := unifiedDiff(hap.ConfigPath, hap.ConfigPath+".new", current, templated); diff != "" {
+			logs.WithF(hap.fields.WithField("diff", diff)).Info("Dry run. Would write configuration file")
+			atomic.AddInt32(&hap.dryRunChanges, 1)
+		}
+		return nil
+	}
+
+	if err := writeFileAtomic(hap.ConfigPath, templated, os.FileMode(hap.ConfigFileMode)); err != nil {
 		return errs.WithEF(err, hap.fields, "Failed to write configuration file")
 	}
+	hap.configWrites.Inc()
+	return nil
+}
+
+// write to a temporary file in the same directory and rename it, so readers never see a partial file
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	fields := data.WithField("file", path)
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return errs.WithEF(err, fields, "Failed to create temporary file")
+	}
+	fields = fields.WithField("tmp", file.Name())
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return errs.WithEF(err, fields, "Failed to write temporary file")
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return errs.WithEF(err, fields, "Failed to set temporary file mode")
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return errs.WithEF(err, fields, "Failed to close temporary file")
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return errs.WithEF(err, fields, "Failed to move temporary file")
+	}
 	return nil
 }
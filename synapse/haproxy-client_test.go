@@ -0,0 +1,237 @@
+package synapse
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// options of router and of its only service are json fields, each ending with a comma
+func newTestHaProxy(t *testing.T, dir string, options string, serviceOptions string) *RouterHaProxy {
+	return newTestRouter(t, newTestSynapse(), `{"type":"haproxy","configPath":"`+dir+`/haproxy.cfg",
+		"reloadCommand":["true"],"reloadMinIntervalInMilli":1,`+options+`
+		"services":[{"name":"api",`+serviceOptions+`"watcher":`+testWatcher+`}]}`).(*RouterHaProxy)
+}
+
+func TestTemplateConfigRendersSections(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  string
+		expected string
+	}{
+		{
+			name: "frontend",
+			options: `"frontend":{"http-in":["bind 127.0.0.1:80","acl is_api hdr(host) -i api","acl is_web hdr(host) -i web",
+				"use_backend api_1 if is_api","use_backend web_2 if is_web"]},`,
+			expected: "frontend http-in\n  bind 127.0.0.1:80\n  acl is_api hdr(host) -i api\n  acl is_web hdr(host) -i web\n" +
+				"  use_backend api_1 if is_api\n  use_backend web_2 if is_web\n",
+		},
+		{
+			name:     "listen",
+			options:  `"listen":{"stats":["mode http","bind 127.0.0.1:1936","stats enable"]},`,
+			expected: "listen stats\n  mode http\n  bind 127.0.0.1:1936\n  stats enable\n",
+		},
+		{
+			name:     "resolvers",
+			options:  `"resolvers":{"dns":["nameserver local 127.0.0.1:53","hold valid 10s"]},`,
+			expected: "resolvers dns\n  nameserver local 127.0.0.1:53\n  hold valid 10s\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestHaProxy(t, dir, test.options, "")
+
+			config, err := router.templateConfig()
+			if err != nil {
+				t.Fatalf("Failed to template configuration: %s", err)
+			}
+			if !strings.Contains(string(config), test.expected) {
+				t.Errorf("Expected section:\n%s\nin configuration:\n%s", test.expected, config)
+			}
+		})
+	}
+}
+
+func TestSocketAddressForms(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		address func(dir string, port string) string
+	}{
+		{name: "bare path", network: "unix", address: func(dir string, port string) string { return dir + "/haproxy.sock" }},
+		{name: "unix url", network: "unix", address: func(dir string, port string) string { return "unix://" + dir + "/haproxy.sock" }},
+		{name: "haproxy unix bind", network: "unix", address: func(dir string, port string) string { return "unix@" + dir + "/haproxy.sock" }},
+		{name: "tcp url", network: "tcp", address: func(dir string, port string) string { return "tcp://127.0.0.1:" + port }},
+		{name: "haproxy ipv4 bind", network: "tcp", address: func(dir string, port string) string { return "ipv4@127.0.0.1:" + port }},
+		{name: "bare host and port", network: "tcp", address: func(dir string, port string) string { return "127.0.0.1:" + port }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			listen := dir + "/haproxy.sock"
+			if test.network == "tcp" {
+				listen = "127.0.0.1:0"
+			}
+			listener, commands := testSocket(t, test.network, listen)
+			defer listener.Close()
+			_, port, _ := net.SplitHostPort(listener.Addr().String())
+			hap := initTestHaProxyClient(t, &HaProxyClient{SocketAddress: test.address(dir, port)})
+
+			if err := hap.runSocketCommand(test.address(dir, port), "show info"); err != nil {
+				t.Fatalf("Failed to run socket command: %s", err)
+			}
+			if command := <-commands; command != "show info" {
+				t.Errorf("Expected command 'show info', got '%s'", command)
+			}
+		})
+	}
+}
+
+func TestCommandsSentToAllSockets(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	listener1, commands1 := testSocket(t, "unix", dir+"/haproxy1.sock")
+	defer listener1.Close()
+	listener2, commands2 := testSocket(t, "unix", dir+"/haproxy2.sock")
+	defer listener2.Close()
+	router := newTestHaProxy(t, dir, `"socketAddress":"`+dir+`/haproxy1.sock","socketAddresses":["`+dir+`/haproxy2.sock"],`, "")
+	if len(router.SocketAddresses) != 2 || router.SocketAddress != "" {
+		t.Fatalf("Expected socketAddress folded into 2 socketAddresses, got %v and '%s'", router.SocketAddresses, router.SocketAddress)
+	}
+	common := router.getCommon()
+	service := common.Services[0]
+
+	for _, weight := range []uint8{100, 30} {
+		server := testServer("api1", "10.0.0.1", 80)
+		server.Weight = testWeight(weight)
+		if err := common.handleReport([]ServiceReport{{Service: service, Reports: []Report{server}}}, router); err != nil {
+			t.Fatalf("Failed to apply report: %s", err)
+		}
+	}
+
+	expected := "set weight api_" + strconv.Itoa(service.id) + "/api1 30"
+	for i, commands := range []<-chan string{commands1, commands2} {
+		if len(commands) != 1 {
+			t.Fatalf("Expected 1 command on socket %d, got %d", i+1, len(commands))
+		}
+		if command := <-commands; command != expected {
+			t.Errorf("Expected command '%s' on socket %d, got '%s'", expected, i+1, command)
+		}
+	}
+}
+
+func TestManagedRegionOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		before  string
+		after   string
+	}{
+		{name: "no file"},
+		{name: "no markers", current: "listen manual\n  bind :8080\n"},
+		{
+			name:    "hand written lines kept around markers",
+			current: "# emergency\nlisten manual\n  bind :8080\n# BEGIN go-synapse\nold\n# END go-synapse\nlisten after\n  bind :8081\n",
+			before:  "# emergency\nlisten manual\n  bind :8080\n",
+			after:   "listen after\n  bind :8081\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			if test.current != "" {
+				if err := ioutil.WriteFile(dir+"/haproxy.cfg", []byte(test.current), 0644); err != nil {
+					t.Fatalf("Failed to write configuration: %s", err)
+				}
+			}
+			router := newTestHaProxy(t, dir, `"managedRegionOnly":true,`, "")
+
+			config, err := router.templateConfig()
+			if err != nil {
+				t.Fatalf("Failed to template configuration: %s", err)
+			}
+			content := string(config)
+			if !strings.HasPrefix(content, test.before+managedRegionBegin+"\n") {
+				t.Errorf("Expected configuration to start with:\n%s\ngot:\n%s", test.before+managedRegionBegin, content)
+			}
+			if !strings.HasSuffix(content, managedRegionEnd+"\n"+test.after) {
+				t.Errorf("Expected configuration to end with:\n%s\ngot:\n%s", managedRegionEnd+"\n"+test.after, content)
+			}
+			if strings.Contains(content, "\nold\n") || strings.Count(content, managedRegionBegin) != 1 {
+				t.Errorf("Expected previous managed region to be replaced, got:\n%s", content)
+			}
+		})
+	}
+}
+
+func TestReloadsOnHold(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	router := newTestHaProxy(t, dir, `"maxReloadFailures":2,"reloadCommand":["sh","-c","test ! -f `+dir+`/fail"],
+		"checkCommand":["sh","-c","test ! -f `+dir+`/invalid"],`, "")
+	touch := func(name string) {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte{}, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+
+	steps := []struct {
+		name   string
+		before func()
+		reload func() error
+		err    bool
+		onHold bool
+	}{
+		{name: "first failure", before: func() { touch("fail") }, reload: router.Reload, err: true},
+		{name: "too many failures", reload: router.Reload, err: true, onHold: true},
+		{name: "reload without write on hold", reload: func() error { return router.reload(false) }, err: true, onHold: true},
+		{name: "invalid configuration keeps hold", before: func() { touch("invalid") }, reload: router.Reload, err: true, onHold: true},
+		{name: "valid configuration failing again holds", before: func() { os.Remove(dir + "/invalid") }, reload: router.Reload, err: true, onHold: true},
+		{name: "valid configuration resumes", before: func() { os.Remove(dir + "/fail") }, reload: router.Reload},
+		{name: "failures restart from zero after success", before: func() { touch("fail") }, reload: router.Reload, err: true},
+		{name: "too many failures again", reload: router.Reload, err: true, onHold: true},
+		{name: "api reload releases", before: router.releaseReloadHold, reload: func() error { return nil }},
+		{name: "failures restart from zero after release", reload: router.Reload, err: true},
+	}
+
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		if err := step.reload(); (err != nil) != step.err {
+			t.Fatalf("%s: expected error %t, got %v", step.name, step.err, err)
+		}
+		if router.reloadsOnHold != step.onHold {
+			t.Fatalf("%s: expected reloads on hold %t", step.name, step.onHold)
+		}
+	}
+}
+
+func TestDryRunDoesNotDrain(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	s := newTestSynapse()
+	s.DryRun = true
+	router := newTestRouter(t, s, `{"type":"haproxy","configPath":"`+dir+`/haproxy.cfg","reloadCommand":["true"],
+		"socketAddress":"`+dir+`/haproxy.sock","drainOnShutdown":true,"drainTimeoutInMilli":10000,
+		"services":[{"name":"api","watcher":`+testWatcher+`}]}`).(*RouterHaProxy)
+	router.Backend["api_1"] = []string{"server api1 10.0.0.1:80"}
+
+	duration, err := router.drain()
+	if err != nil || duration != 0 {
+		t.Errorf("Expected no drain wait in dry run, got %s, %v", duration, err)
+	}
+	if router.dryRunChanged() {
+		t.Errorf("Expected drain on shutdown not to count as a dry run change")
+	}
+}
@@ -0,0 +1,111 @@
+package synapse
+
+import (
+	"encoding/json"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+type haProxyState struct {
+	Time     int64
+	Frontend map[string][]string
+	Backend  map[string][]string
+}
+
+// last good state is only written when good, with every service having enough active servers
+func (hap *HaProxyClient) saveState(good bool) error {
+	if hap.dryRun || (hap.StatePath == "" && hap.GoodStatePath == "") {
+		return nil
+	}
+
+	content, err := json.Marshal(haProxyState{
+		Time:     time.Now().UnixNano() / int64(time.Millisecond),
+		Frontend: hap.Frontend,
+		Backend:  hap.Backend,
+	})
+	if err != nil {
+		return errs.WithEF(err, hap.fields, "Failed to marshal haproxy state")
+	}
+	for _, path := range []string{hap.StatePath, hap.GoodStatePath} {
+		if path == "" || (path == hap.GoodStatePath && !good) {
+			continue
+		}
+		if err := writeFileAtomic(path, content, os.FileMode(hap.StateFileMode)); err != nil {
+			return errs.WithEF(err, hap.fields.WithField("state", path), "Failed to write haproxy state")
+		}
+	}
+	return nil
+}
+
+// next start waits for fresh discovery instead of reusing servers of this run. Last good state is kept
+func (hap *HaProxyClient) cleanStateOnShutdown() {
+	if !hap.RemoveStateOnShutdown || hap.StatePath == "" || hap.dryRun {
+		return
+	}
+	if err := os.Remove(hap.StatePath); err != nil && !os.IsNotExist(err) {
+		logs.WithEF(err, hap.fields.WithField("state", hap.StatePath)).Warn("Failed to remove haproxy state")
+		return
+	}
+	logs.WithF(hap.fields.WithField("state", hap.StatePath)).Info("Haproxy state removed on shutdown")
+}
+
+// load frontends and backends of previous run for the given names, if state is not older than the ttl.
+// Names still missing are then taken from the last good state, if not older than its own ttl
+func (hap *HaProxyClient) loadState(names []string) error {
+	if hap.StatePath != "" {
+		if err := hap.loadStateFile(hap.StatePath, names, *hap.StateFileTtlInMilli); err != nil {
+			return err
+		}
+	}
+
+	if hap.GoodStatePath != "" {
+		missing := []string{}
+		for _, name := range names {
+			if _, ok := hap.Backend[name]; !ok {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return hap.loadStateFile(hap.GoodStatePath, missing, *hap.GoodStateFileTtlInMilli)
+		}
+	}
+	return nil
+}
+
+func (hap *HaProxyClient) loadStateFile(path string, names []string, ttlInMilli int) error {
+	fields := hap.fields.WithField("state", path)
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logs.WithF(fields).Debug("No haproxy state file to load")
+			return nil
+		}
+		return errs.WithEF(err, fields, "Failed to read haproxy state")
+	}
+
+	state := haProxyState{}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return errs.WithEF(err, fields, "Failed to unmarshal haproxy state")
+	}
+
+	age := time.Now().UnixNano()/int64(time.Millisecond) - state.Time
+	if ttlInMilli > 0 && age > int64(ttlInMilli) {
+		logs.WithF(fields.WithField("age", age)).Info("Haproxy state file is expired. Ignoring")
+		return nil
+	}
+
+	for _, name := range names {
+		if front, ok := state.Frontend[name]; ok {
+			hap.Frontend[name] = front
+		}
+		if back, ok := state.Backend[name]; ok {
+			hap.Backend[name] = back
+		}
+	}
+	logs.WithF(fields.WithField("age", age)).Info("Haproxy state loaded")
+	return nil
+}
@@ -0,0 +1,131 @@
+package synapse
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func writeTestState(t *testing.T, path string, ageInMilli int64, backend []string) {
+	content, err := json.Marshal(haProxyState{
+		Time:     time.Now().UnixNano()/int64(time.Millisecond) - ageInMilli,
+		Frontend: map[string][]string{"api_1": {"default_backend api_1"}},
+		Backend:  map[string][]string{"api_1": backend},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal state: %s", err)
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Failed to write state: %s", err)
+	}
+}
+
+func initTestHaProxyClient(t *testing.T, client *HaProxyClient) *HaProxyClient {
+	if err := client.Init(); err != nil {
+		t.Fatalf("Failed to init haproxy client: %s", err)
+	}
+	return client
+}
+
+func TestLoadStateTtl(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttlInMilli int
+		ageInMilli int64
+		loaded     bool
+	}{
+		{name: "fresh", ttlInMilli: 2000, ageInMilli: 100, loaded: true},
+		{name: "expired", ttlInMilli: 2000, ageInMilli: 5000, loaded: false},
+		{name: "never expire", ttlInMilli: 0, ageInMilli: 30 * 24 * 3600 * 1000, loaded: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			writeTestState(t, dir+"/hap.state", test.ageInMilli, []string{"server api1 10.0.0.1:80"})
+			ttl := test.ttlInMilli
+			hap := initTestHaProxyClient(t, &HaProxyClient{StatePath: dir + "/hap.state", StateFileTtlInMilli: &ttl})
+
+			if err := hap.loadState([]string{"api_1"}); err != nil {
+				t.Fatalf("Failed to load state: %s", err)
+			}
+			if _, loaded := hap.Backend["api_1"]; loaded != test.loaded {
+				t.Errorf("Expected state loaded %t, got %t", test.loaded, loaded)
+			}
+		})
+	}
+}
+
+func TestGoodStateWrittenWithMinimumServers(t *testing.T) {
+	tests := []struct {
+		name      string
+		service   string
+		available []bool
+		written   bool
+	}{
+		{name: "all available", available: []bool{true, true}, written: true},
+		{name: "minimum reached", service: `"minimumHosts":2,`, available: []bool{true, true, false}, written: true},
+		{name: "below minimum", service: `"minimumHosts":2,`, available: []bool{true, false}, written: false},
+		{name: "disabled by ratio", service: `"minAvailableRatio":0.5,`, available: []bool{true, false, false}, written: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestHaProxy(t, dir, `"statePath":"`+dir+`/hap.state","goodStatePath":"`+dir+`/hap.good.state",`, test.service)
+			common := router.getCommon()
+
+			report := ServiceReport{Service: common.Services[0]}
+			for i, available := range test.available {
+				server := testServer("api"+strconv.Itoa(i), "10.0.0."+strconv.Itoa(i+1), 80)
+				server.Available = testBool(available)
+				report.Reports = append(report.Reports, server)
+			}
+			if err := common.handleReport([]ServiceReport{report}, router); err != nil {
+				t.Fatalf("Failed to apply report: %s", err)
+			}
+
+			if readTestFile(t, dir+"/hap.state") == "" {
+				t.Errorf("Expected state to be written")
+			}
+			if written := readTestFile(t, dir+"/hap.good.state") != ""; written != test.written {
+				t.Errorf("Expected good state written %t, got %t", test.written, written)
+			}
+		})
+	}
+}
+
+func TestLoadGoodStateTtl(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttlInMilli *int
+		ageInMilli int64
+		loaded     bool
+	}{
+		{name: "fresh", ageInMilli: 100, loaded: true},
+		{name: "expired with state ttl", ageInMilli: 5000, loaded: false},
+		{name: "own ttl", ttlInMilli: testInt(60000), ageInMilli: 5000, loaded: true},
+		{name: "never expire", ttlInMilli: testInt(0), ageInMilli: 30 * 24 * 3600 * 1000, loaded: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			writeTestState(t, dir+"/hap.good.state", test.ageInMilli, []string{"server api1 10.0.0.1:80"})
+			hap := initTestHaProxyClient(t, &HaProxyClient{GoodStatePath: dir + "/hap.good.state", GoodStateFileTtlInMilli: test.ttlInMilli})
+
+			if err := hap.loadState([]string{"api_1"}); err != nil {
+				t.Fatalf("Failed to load state: %s", err)
+			}
+			if _, loaded := hap.Backend["api_1"]; loaded != test.loaded {
+				t.Errorf("Expected good state loaded %t, got %t", test.loaded, loaded)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package synapse
+
+import (
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"net"
+	"strings"
+	"time"
+)
+
+// addresses of all 'bind' lines of frontends and listens, as network and address to dial
+func (hap *HaProxyClient) bindAddresses() [][2]string {
+	addresses := [][2]string{}
+	sections := []map[string][]string{hap.Frontend, hap.Listen}
+	for _, section := range sections {
+		for _, lines := range section {
+			for _, line := range lines {
+				fields := strings.Fields(line)
+				if len(fields) < 2 || fields[0] != "bind" {
+					continue
+				}
+				for _, bind := range strings.Split(fields[1], ",") {
+					if network, address, ok := bindToDial(bind); ok {
+						addresses = append(addresses, [2]string{network, address})
+					}
+				}
+			}
+		}
+	}
+	return addresses
+}
+
+func bindToDial(bind string) (string, string, bool) {
+	switch {
+	case strings.HasPrefix(bind, "unix@"):
+		return "unix", strings.TrimPrefix(bind, "unix@"), true
+	case strings.HasPrefix(bind, "/"):
+		return "unix", bind, true
+	case strings.HasPrefix(bind, "ipv4@"):
+		bind = strings.TrimPrefix(bind, "ipv4@")
+	case strings.HasPrefix(bind, "ipv6@"):
+		bind = strings.TrimPrefix(bind, "ipv6@")
+	case strings.Contains(bind, "@"):
+		return "", "", false // abns, fd, sockpair...
+	}
+
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return "", "", false
+	}
+	if i := strings.Index(port, "-"); i > 0 {
+		port = port[:i] // port range, first one is enough
+	}
+	if host == "" || host == "*" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	} else if host == "::" {
+		host = "::1"
+	}
+	return "tcp", net.JoinHostPort(host, port), true
+}
+
+// check that haproxy accepts connections on all its binds, retrying until the reload timeout
+func (hap *HaProxyClient) verifyListen() error {
+	deadline := time.Now().Add(time.Duration(hap.ReloadTimeoutInMilli) * time.Millisecond)
+	for _, bind := range hap.bindAddresses() {
+		fields := hap.fields.WithField("bind", bind[1])
+		for {
+			conn, err := net.DialTimeout(bind[0], bind[1], deadline.Sub(time.Now()))
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				return errs.WithEF(err, fields, "Haproxy is not listening after reload")
+			}
+			logs.WithEF(err, fields).Trace("Haproxy not listening yet")
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// put back the previous configuration file and reload haproxy with it
+func (hap *HaProxyClient) rollback(previous []byte, env []string) error {
+	logs.WithF(hap.fields).Warn("Rolling back to previous haproxy configuration")
+	if err := hap.writeFile(previous); err != nil {
+		return errs.WithEF(err, hap.fields, "Failed to write previous haproxy configuration")
+	}
+	if err := execCommand(hap.reloadCommand(), env, hap.ReloadTimeoutInMilli); err != nil {
+		return errs.WithEF(err, hap.fields, "Failed to reload haproxy with previous configuration")
+	}
+	hap.reloads.Inc()
+	return nil
+}
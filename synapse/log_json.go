@@ -0,0 +1,76 @@
+package synapse
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/n0rad/go-erlog"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"io"
+	"sync"
+	"time"
+)
+
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+
+// write one json object per log line, with defaultFields added to all of them
+type jsonLogAppender struct {
+	out           io.Writer
+	level         logs.Level
+	defaultFields data.Fields
+	mutex         sync.Mutex
+}
+
+func useJsonLogs(out io.Writer, defaultFields data.Fields) error {
+	logger, ok := logs.GetDefaultLog().(*erlog.ErlogLogger)
+	if !ok {
+		return errs.With("Json log format is only supported with erlog logger")
+	}
+	logger.Appenders = []erlog.Appender{&jsonLogAppender{out: out, defaultFields: defaultFields}}
+	return nil
+}
+
+func (a *jsonLogAppender) GetLevel() logs.Level {
+	return a.level
+}
+
+func (a *jsonLogAppender) SetLevel(level logs.Level) {
+	a.level = level
+}
+
+func (a *jsonLogAppender) Fire(event *erlog.LogEvent) {
+	line := make(map[string]interface{})
+	for k, v := range a.defaultFields {
+		line[k] = jsonValue(v)
+	}
+	for k, v := range event.Fields {
+		line[k] = jsonValue(v)
+	}
+	line["time"] = time.Now().Format(time.RFC3339Nano)
+	line["level"] = event.Level.String()
+	line["file"] = event.File
+	line["line"] = event.Line
+	line["message"] = event.Message
+	if event.Err != nil {
+		line["error"] = event.Err.Error()
+	}
+
+	content, err := json.Marshal(line)
+	if err != nil {
+		content = []byte(fmt.Sprintf(`{"level":"ERROR","message":"Failed to marshal log line","error":%q}`, err.Error()))
+	}
+	content = append(content, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.out.Write(content)
+}
+
+func jsonValue(v interface{}) interface{} {
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprintf("%+v", v)
+	}
+	return v
+}
@@ -1,25 +1,60 @@
 package synapse
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"github.com/blablacar/go-nerve/nerve"
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/logs"
+	"github.com/samuel/go-zookeeper/zk"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 const PrometheusLabelContent = "content"
 
+// highest report version this synapse knows. Newer reports are read on a best effort basis
+const REPORT_VERSION = 1
+
 type reportMap struct {
 	sync.RWMutex
-	service *Service
-	m       map[string]Report
-	changed chan struct{}
+	service          *Service
+	labelFilter      map[string]string
+	deduplicateHosts bool
+	m                map[string]Report
+	changed          chan struct{}
+	unknownVersions  map[string]struct{}
+	changeTime       time.Time // arrival of the oldest change not sent yet
 }
 
 type Report struct {
 	nerve.Report
+	ServerReport
 	CreationTime int64
+	// last modification in the registry, unix milli. 0 if unknown
+	ModificationTime int64
+	// zookeeper transaction of the last modification, orders modifications done in the same millisecond
+	modificationZxid int64
+	// forced out of rotation by api
+	disabled bool
+}
+
+// server attributes not part of the nerve report
+type ServerReport struct {
+	MaxConn    *int   `json:"maxconn,omitempty"`
+	Check      bool   `json:"check,omitempty"`
+	CheckInter *int   `json:"check_inter,omitempty"`
+	CheckRise  *int   `json:"check_rise,omitempty"`
+	CheckFall  *int   `json:"check_fall,omitempty"`
+	Version    int    `json:"version,omitempty"`
+	SocketPath string `json:"socket_path,omitempty"` // unix socket address, used when port is 0
+
+	LatencyInMilli *int `json:"latency_in_milli,omitempty"` // only used for sorting
 }
 
 func NewReportMap(service *Service) *reportMap {
@@ -28,34 +63,140 @@ func NewReportMap(service *Service) *reportMap {
 	}
 	n.m = make(map[string]Report)
 	n.changed = make(chan struct{})
+	n.unknownVersions = make(map[string]struct{})
 	return &n
 }
 
-func (n *reportMap) setNoNodes() {
-	n.Lock()
-	n.m = make(map[string]Report)
-	n.Unlock()
-	n.changed <- struct{}{}
-}
+func (n *reportMap) parseRawReport(name string, content []byte, failFields data.Fields) (Report, bool) {
+	if isGzip(content) {
+		uncompressed, err := gunzip(content)
+		if err != nil {
+			n.service.synapse.watcherFailures.WithLabelValues(n.service.Name, PrometheusLabelContent).Inc()
+			logs.WithEF(err, failFields).Warn("Failed to uncompress gzip report")
+			return Report{}, false
+		}
+		content = uncompressed
+	}
+
+	version := struct {
+		Version int `json:"version"`
+	}{}
+	json.Unmarshal(content, &version)
+	if version.Version > REPORT_VERSION {
+		n.Lock()
+		_, warned := n.unknownVersions[name]
+		n.unknownVersions[name] = struct{}{}
+		n.Unlock()
+		if !warned {
+			logs.WithF(failFields.WithField("version", version.Version).WithField("known", REPORT_VERSION)).
+				Warn("Unknown report version. Reading known fields only")
+		}
+	}
 
-func (n *reportMap) addRawReport(name string, content []byte, failFields data.Fields, creationTime int64) {
 	r := nerve.Report{}
 	if err := json.Unmarshal(content, &r); err != nil {
+		if version.Version <= REPORT_VERSION {
+			n.service.synapse.watcherFailures.WithLabelValues(n.service.Name, PrometheusLabelContent).Inc()
+			logs.WithEF(err, failFields.WithField("content", string(content))).Warn("Failed to unmarshal report")
+			return Report{}, false
+		}
+		minimal, ok := n.parseMinimalReport(content, failFields)
+		if !ok {
+			return Report{}, false
+		}
+		return Report{Report: minimal, ServerReport: ServerReport{Version: version.Version}}, true
+	}
+	s := ServerReport{}
+	if err := json.Unmarshal(content, &s); err != nil {
+		if version.Version <= REPORT_VERSION {
+			n.service.synapse.watcherFailures.WithLabelValues(n.service.Name, PrometheusLabelContent).Inc()
+			logs.WithEF(err, failFields.WithField("content", string(content))).Warn("Failed to unmarshal server report")
+			return Report{}, false
+		}
+		s = ServerReport{Version: version.Version}
+	}
+	return Report{Report: r, ServerReport: s}, true
+}
+
+// read only fields needed to route, when a newer report format changed others
+func (n *reportMap) parseMinimalReport(content []byte, failFields data.Fields) (nerve.Report, bool) {
+	minimal := struct {
+		Available *bool      `json:"available"`
+		Host      string     `json:"host"`
+		Port      nerve.Port `json:"port"`
+		Name      string     `json:"name"`
+	}{}
+	if err := json.Unmarshal(content, &minimal); err != nil {
 		n.service.synapse.watcherFailures.WithLabelValues(n.service.Name, PrometheusLabelContent).Inc()
 		logs.WithEF(err, failFields.WithField("content", string(content))).Warn("Failed to unmarshal report")
+		return nerve.Report{}, false
+	}
+	r := nerve.Report{Available: minimal.Available, Host: minimal.Host, Port: minimal.Port, Name: minimal.Name}
+	if r.Available != nil && !*r.Available {
+		weight := uint8(0)
+		r.Weight = &weight
+	}
+	return r, true
+}
+
+func (n *reportMap) addRawReport(name string, content []byte, failFields data.Fields, stat *zk.Stat) {
+	report, ok := n.parseRawReport(name, content, failFields)
+	if !ok {
 		return
 	}
+	report.CreationTime = stat.Ctime
+	report.ModificationTime = stat.Mtime
+	report.modificationZxid = stat.Mzxid
 	n.Lock()
-	n.m[name] = Report{r, creationTime}
+	n.markChanged()
+	if n.matchLabels(report.Labels) {
+		n.m[name] = report
+	} else {
+		logs.WithF(failFields.WithField("labels", report.Labels)).Debug("Report labels do not match filter. Ignoring server")
+		delete(n.m, name)
+	}
 	n.Unlock()
 	n.changed <- struct{}{}
 }
 
-func (n *reportMap) removeAll() {
+// replace all reports at once, keeping creation time of servers already known
+func (n *reportMap) setReports(reports map[string]Report, creationTime int64) {
+	n.Lock()
+	m := make(map[string]Report)
+	for name, report := range reports {
+		if !n.matchLabels(report.Labels) {
+			continue
+		}
+		report.CreationTime = creationTime
+		if previous, ok := n.m[name]; ok {
+			report.CreationTime = previous.CreationTime
+		}
+		m[name] = report
+	}
+	n.m = m
+	n.markChanged()
+	n.Unlock()
+	n.changed <- struct{}{}
+}
+
+func (n *reportMap) matchLabels(labels map[string]string) bool {
+	for k, v := range n.labelFilter {
+		if label, ok := labels[k]; !ok || label != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *reportMap) removePrefix(prefix string) {
 	n.Lock()
 	for k := range n.m {
-		delete(n.m, k)
+		if strings.HasPrefix(k, prefix) {
+			delete(n.m, k)
+			delete(n.unknownVersions, k)
+		}
 	}
+	n.markChanged()
 	n.Unlock()
 	n.changed <- struct{}{}
 }
@@ -63,6 +204,8 @@ func (n *reportMap) removeAll() {
 func (n *reportMap) removeNode(name string) {
 	n.Lock()
 	delete(n.m, name)
+	delete(n.unknownVersions, name)
+	n.markChanged()
 	n.Unlock()
 	n.changed <- struct{}{}
 }
@@ -74,12 +217,102 @@ func (n *reportMap) get(name string) (Report, bool) {
 	return value, ok
 }
 
-func (n *reportMap) getValues() []Report {
-	n.RLock()
-	defer n.RUnlock()
+// must be called with the lock held
+func (n *reportMap) markChanged() {
+	if n.changeTime.IsZero() {
+		n.changeTime = time.Now()
+	}
+}
+
+// values to send, with the arrival time of the oldest change they contain. Following changes get a new time
+func (n *reportMap) takeValues() ([]Report, time.Time) {
+	n.Lock()
+	defer n.Unlock()
+	changeTime := n.changeTime
+	n.changeTime = time.Time{}
+	if changeTime.IsZero() {
+		changeTime = time.Now()
+	}
+	return n.values(), changeTime
+}
+
+func (n *reportMap) values() []Report {
 	r := []Report{}
+	if !n.deduplicateHosts {
+		for _, v := range n.m {
+			r = append(r, v)
+		}
+		return r
+	}
+
+	// keep the most recent report for each address
+	byAddress := make(map[string]Report)
 	for _, v := range n.m {
+		address := v.address()
+		if previous, ok := byAddress[address]; ok {
+			dropped := v
+			if v.isFresherThan(previous) {
+				byAddress[address] = v
+				dropped = previous
+			}
+			logs.WithF(data.WithField("address", address).WithField("dropped", dropped.Name)).Debug("Dropping duplicate server")
+			continue
+		}
+		byAddress[address] = v
+	}
+	for _, v := range byAddress {
 		r = append(r, v)
 	}
 	return r
 }
+
+// last modified in registry, or last created when modification is unknown
+func (r Report) isFresherThan(other Report) bool {
+	if r.ModificationTime != other.ModificationTime {
+		return r.ModificationTime > other.ModificationTime
+	}
+	if r.modificationZxid != other.modificationZxid {
+		return r.modificationZxid > other.modificationZxid
+	}
+	return r.CreationTime > other.CreationTime
+}
+
+func isGzip(content []byte) bool {
+	return len(content) > 2 && content[0] == 0x1f && content[1] == 0x8b
+}
+
+func gunzip(content []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func (s ServerReport) Equals(o ServerReport) bool {
+	return equalsIntPtr(s.MaxConn, o.MaxConn) &&
+		s.Check == o.Check &&
+		equalsIntPtr(s.CheckInter, o.CheckInter) &&
+		equalsIntPtr(s.CheckRise, o.CheckRise) &&
+		equalsIntPtr(s.CheckFall, o.CheckFall) &&
+		s.SocketPath == o.SocketPath
+}
+
+func (r Report) isUnixSocket() bool {
+	return r.Port == 0 && r.SocketPath != ""
+}
+
+func (r Report) address() string {
+	if r.isUnixSocket() {
+		return r.SocketPath
+	}
+	return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port))) // brackets ipv6 hosts
+}
+
+func equalsIntPtr(a *int, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
+	"hash/fnv"
 	"math/rand"
 	"sort"
 	"strings"
@@ -22,9 +23,20 @@ func (n ReportSortType) Sort(reports *[]Report) {
 		sort.Sort(ByName{*reports})
 	case SORT_DATE:
 		sort.Sort(ByDate{*reports})
+	case SORT_LATENCY:
+		SORT_RANDOM.Sort(reports)
+		sort.Stable(ByLatency{*reports})
+	case SORT_HASH:
+		sort.Sort(ByHash{*reports})
 	}
 }
 
+// random inside groups of a same label value. Groups follow order, then other values by name, then servers without the label
+func sortByLabel(reports *[]Report, label string, order []string) {
+	SORT_RANDOM.Sort(reports)
+	sort.Stable(ByLabel{Reports: *reports, label: label, order: order})
+}
+
 type Reports []Report
 
 func (s Reports) Len() int {
@@ -46,6 +58,61 @@ func (s ByDate) Less(i, j int) bool {
 	return s.Reports[i].CreationTime < s.Reports[j].CreationTime
 }
 
+// servers without latency go last
+type ByLatency struct{ Reports }
+
+func (s ByLatency) Less(i, j int) bool {
+	if s.Reports[j].LatencyInMilli == nil {
+		return s.Reports[i].LatencyInMilli != nil
+	}
+	return s.Reports[i].LatencyInMilli != nil && *s.Reports[i].LatencyInMilli < *s.Reports[j].LatencyInMilli
+}
+
+// stable and uniform order, identical on all instances for a same set of servers
+type ByHash struct{ Reports }
+
+func (s ByHash) Less(i, j int) bool {
+	hi, hj := nameHash(s.Reports[i].Name), nameHash(s.Reports[j].Name)
+	if hi == hj {
+		return s.Reports[i].Name < s.Reports[j].Name
+	}
+	return hi < hj
+}
+
+type ByLabel struct {
+	Reports
+	label string
+	order []string
+}
+
+func (s ByLabel) Less(i, j int) bool {
+	vi, oki := s.Reports[i].Labels[s.label]
+	vj, okj := s.Reports[j].Labels[s.label]
+	if !oki || !okj {
+		return oki && !okj
+	}
+	ri, rj := s.rank(vi), s.rank(vj)
+	if ri != rj {
+		return ri < rj
+	}
+	return ri == len(s.order) && vi < vj
+}
+
+func (s ByLabel) rank(value string) int {
+	for i, v := range s.order {
+		if v == value {
+			return i
+		}
+	}
+	return len(s.order)
+}
+
+func nameHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
 func (n *ReportSortType) UnmarshalJSON(d []byte) error {
 	var s string
 	if err := json.Unmarshal(d, &s); err != nil {
@@ -59,6 +126,14 @@ func (n *ReportSortType) UnmarshalJSON(d []byte) error {
 		*n = SORT_NAME
 	case string(SORT_DATE):
 		*n = SORT_DATE
+	case string(SORT_LATENCY):
+		*n = SORT_LATENCY
+	case string(SORT_HASH):
+		*n = SORT_HASH
+	case string(SORT_LABEL):
+		*n = SORT_LABEL
+	case string(SORT_ZONE):
+		*n = SORT_ZONE
 	default:
 		return errs.WithF(data.WithField("value", s), "Unknown serverSort")
 	}
@@ -68,3 +143,7 @@ func (n *ReportSortType) UnmarshalJSON(d []byte) error {
 const SORT_RANDOM ReportSortType = "random"
 const SORT_NAME ReportSortType = "name"
 const SORT_DATE ReportSortType = "date"
+const SORT_LATENCY ReportSortType = "latency"
+const SORT_HASH ReportSortType = "hash"
+const SORT_LABEL ReportSortType = "label"
+const SORT_ZONE ReportSortType = "zone"
@@ -0,0 +1,83 @@
+package synapse
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testSortedNames(sortType ReportSortType, names []string) string {
+	reports := []Report{}
+	for _, name := range names {
+		reports = append(reports, testServer(name, "10.0.0.1", 80))
+	}
+	sortType.Sort(&reports)
+	sorted := []string{}
+	for _, report := range reports {
+		sorted = append(sorted, report.Name)
+	}
+	return strings.Join(sorted, ",")
+}
+
+func TestHashSortIsStable(t *testing.T) {
+	tests := []struct {
+		name     string
+		names    []string
+		expected string
+	}{
+		{name: "fixed input", names: []string{"api1", "api2", "api3", "api4", "api5"}, expected: "api5,api4,api3,api2,api1"},
+		{name: "reversed input", names: []string{"api5", "api4", "api3", "api2", "api1"}, expected: "api5,api4,api3,api2,api1"},
+		{name: "shuffled input", names: []string{"api3", "api1", "api5", "api2", "api4"}, expected: "api5,api4,api3,api2,api1"},
+		{name: "server removed", names: []string{"api1", "api2", "api4", "api5"}, expected: "api5,api4,api2,api1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				if sorted := testSortedNames(SORT_HASH, test.names); sorted != test.expected {
+					t.Fatalf("Expected order %s, got %s", test.expected, sorted)
+				}
+			}
+		})
+	}
+}
+
+func TestZoneSort(t *testing.T) {
+	tests := []struct {
+		name     string
+		zones    []string
+		expected string
+	}{
+		{name: "local zone first", zones: []string{"eu-west-1b", "eu-west-1a", "eu-west-1c", "eu-west-1a"}, expected: "eu-west-1a,eu-west-1a,eu-west-1b,eu-west-1c"},
+		{name: "no server in local zone", zones: []string{"eu-west-1c", "eu-west-1b"}, expected: "eu-west-1b,eu-west-1c"},
+		{name: "servers without label last", zones: []string{"", "eu-west-1b", "eu-west-1a", ""}, expected: "eu-west-1a,eu-west-1b,,"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestSynapse()
+			s.Zone = "eu-west-1a"
+			router := newTestRouter(t, s, `{"type":"console","services":[{"name":"api","serverSort":"zone","watcher":`+testWatcher+`}]}`)
+			service := router.getCommon().Services[0]
+
+			for i := 0; i < 10; i++ {
+				reports := []Report{}
+				for j, zone := range test.zones {
+					report := testServer("api"+strconv.Itoa(j), "10.0.0.1", 80+j)
+					if zone != "" {
+						report.Labels = map[string]string{"az": zone}
+					}
+					reports = append(reports, report)
+				}
+				service.sortReports(&reports)
+				zones := []string{}
+				for _, report := range reports {
+					zones = append(zones, report.Labels["az"])
+				}
+				if sorted := strings.Join(zones, ","); sorted != test.expected {
+					t.Fatalf("Expected zones %s, got %s", test.expected, sorted)
+				}
+			}
+		})
+	}
+}
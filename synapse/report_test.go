@@ -0,0 +1,164 @@
+package synapse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/samuel/go-zookeeper/zk"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestReportMap() *reportMap {
+	reports := NewReportMap(&Service{Name: "api", synapse: newTestSynapse()})
+	go func() {
+		for range reports.changed {
+		}
+	}()
+	return reports
+}
+
+func TestDiscoveryTimeIsArrivalOfOldestChange(t *testing.T) {
+	reports := newTestReportMap()
+	defer close(reports.changed)
+
+	before := time.Now()
+	reports.addRawReport("api1", []byte(`{"name":"api1","host":"10.0.0.1","port":80}`), nil, &zk.Stat{})
+	time.Sleep(20 * time.Millisecond)
+	reports.removeNode("api2")
+
+	values, discoveryTime := reports.takeValues()
+	if len(values) != 1 {
+		t.Fatalf("Expected 1 server, got %d", len(values))
+	}
+	if discoveryTime.Before(before) || discoveryTime.After(before.Add(10*time.Millisecond)) {
+		t.Errorf("Expected discovery time of the first change, got %s after it", discoveryTime.Sub(before))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	after := time.Now()
+	reports.removeNode("api1")
+	if _, discoveryTime := reports.takeValues(); discoveryTime.Before(after) {
+		t.Errorf("Expected discovery time of change following last taken values, got %s before it", after.Sub(discoveryTime))
+	}
+}
+
+type testNode struct {
+	name    string
+	content string
+	stat    zk.Stat
+}
+
+// names of servers to send after adding nodes in order
+func testDeduplicate(t *testing.T, deduplicateHosts bool, nodes []testNode) []string {
+	reports := newTestReportMap()
+	defer close(reports.changed)
+	reports.deduplicateHosts = deduplicateHosts
+	for _, node := range nodes {
+		stat := node.stat
+		reports.addRawReport(node.name, []byte(node.content), nil, &stat)
+	}
+	values, _ := reports.takeValues()
+	names := []string{}
+	for _, value := range values {
+		names = append(names, value.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDeduplicateHosts(t *testing.T) {
+	api1 := `{"name":"api1","host":"10.0.0.1","port":80}`
+	api1Again := `{"name":"api1-again","host":"10.0.0.1","port":80}`
+	tests := []struct {
+		name        string
+		deduplicate bool
+		nodes       []testNode
+		expected    []string
+	}{
+		{
+			name:     "duplicates kept without deduplication",
+			nodes:    []testNode{{"/api/1", api1, zk.Stat{Ctime: 1}}, {"/api/2", api1Again, zk.Stat{Ctime: 2}}},
+			expected: []string{"api1", "api1-again"},
+		},
+		{
+			name:        "most recent kept",
+			deduplicate: true,
+			nodes:       []testNode{{"/api/1", api1, zk.Stat{Ctime: 1}}, {"/api/2", api1Again, zk.Stat{Ctime: 2}}},
+			expected:    []string{"api1-again"},
+		},
+		{
+			name:        "most recent kept whatever the arrival order",
+			deduplicate: true,
+			nodes:       []testNode{{"/api/2", api1Again, zk.Stat{Ctime: 2}}, {"/api/1", api1, zk.Stat{Ctime: 1}}},
+			expected:    []string{"api1-again"},
+		},
+		{
+			name:        "newer modification time wins over newer creation",
+			deduplicate: true,
+			nodes: []testNode{{"/api/1", api1, zk.Stat{Ctime: 1, Mtime: 5}},
+				{"/api/2", api1Again, zk.Stat{Ctime: 2, Mtime: 3}}},
+			expected: []string{"api1"},
+		},
+		{
+			name:        "same modification time, highest zxid wins",
+			deduplicate: true,
+			nodes: []testNode{{"/api/2", api1Again, zk.Stat{Ctime: 2, Mtime: 5, Mzxid: 10}},
+				{"/api/1", api1, zk.Stat{Ctime: 1, Mtime: 5, Mzxid: 11}}},
+			expected: []string{"api1"},
+		},
+		{
+			name:        "same modification time, highest zxid wins whatever the arrival order",
+			deduplicate: true,
+			nodes: []testNode{{"/api/1", api1, zk.Stat{Ctime: 1, Mtime: 5, Mzxid: 11}},
+				{"/api/2", api1Again, zk.Stat{Ctime: 2, Mtime: 5, Mzxid: 10}}},
+			expected: []string{"api1"},
+		},
+		{
+			name:        "other port is not a duplicate",
+			deduplicate: true,
+			nodes: []testNode{{"/api/1", api1, zk.Stat{Ctime: 1}},
+				{"/api/2", `{"name":"api2","host":"10.0.0.1","port":81}`, zk.Stat{Ctime: 2}}},
+			expected: []string{"api1", "api2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if names := testDeduplicate(t, test.deduplicate, test.nodes); strings.Join(names, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("Expected servers %v, got %v", test.expected, names)
+			}
+		})
+	}
+}
+
+func testGzip(t *testing.T, content string) string {
+	var b bytes.Buffer
+	writer := gzip.NewWriter(&b)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatalf("Failed to compress report: %s", err)
+	}
+	writer.Close()
+	return b.String()
+}
+
+func TestGzipReports(t *testing.T) {
+	reports := newTestReportMap()
+	defer close(reports.changed)
+
+	reports.addRawReport("/api/1", []byte(`{"name":"api1","host":"10.0.0.1","port":80}`), nil, &zk.Stat{})
+	reports.addRawReport("/api/2", []byte(testGzip(t, `{"name":"api2","host":"10.0.0.2","port":80}`)), nil, &zk.Stat{})
+	reports.addRawReport("/api/3", []byte(testGzip(t, `{"name":"api3","host":"10.0.0.3","port":80}`)[:12]), nil, &zk.Stat{})
+	reports.addRawReport("/api/4", []byte(testGzip(t, `not json`)), nil, &zk.Stat{})
+
+	values, _ := reports.takeValues()
+	names := []string{}
+	for _, value := range values {
+		names = append(names, value.Name+"@"+value.Host)
+	}
+	sort.Strings(names)
+	if expected := "api1@10.0.0.1,api2@10.0.0.2"; strings.Join(names, ",") != expected {
+		t.Errorf("Expected servers %s, got %s", expected, strings.Join(names, ","))
+	}
+}
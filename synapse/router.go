@@ -1,10 +1,12 @@
 package synapse
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,20 +14,58 @@ import (
 type RouterCommon struct {
 	Type                        string
 	EventsBufferDurationInMilli int
+	ServerOptions               json.RawMessage // default of services without serverOptions
 	Services                    []*Service
 
-	synapse    *Synapse
-	lastEvents map[*Service]*ServiceReport
-	fields     data.Fields
+	synapse         *Synapse
+	lastEvents      map[*Service]*ServiceReport
+	lastReceived    map[*Service]ServiceReport
+	fields          data.Fields
+	handleMutex     sync.Mutex
+	events          chan ServiceReport
+	oneshot         bool
+	watcherContexts map[*Service]*ContextImpl
+	paused          bool
+	pendingEvents   map[*Service]ServiceReport // received while paused
+	firstRound      chan struct{}              // closed once a report of each service was handled
+	firstRoundOnce  sync.Once
 }
 
 type Router interface {
 	Init(s *Synapse) error
 	getFields() data.Fields
+	getCommon() *RouterCommon
 	Run(context *ContextImpl)
 	Update(serviceReports []ServiceReport) error
 	ParseServerOptions(data []byte) (interface{}, error)
 	ParseRouterOptions(data []byte) (interface{}, error)
+	removeService(service *Service) error
+	validate(fields data.Fields) []error // checks of configuration done before Init, also used by Validate
+}
+
+// routers that can stop sending traffic to their servers before synapse exits
+type drainer interface {
+	drain() (time.Duration, error)
+}
+
+// routers keeping a state for next start, that may have to drop it on clean shutdown
+type stateCleaner interface {
+	cleanStateOnShutdown()
+}
+
+// routers that can regenerate and apply their configuration without any discovery change
+type forceReloader interface {
+	forceReload() (string, error)
+}
+
+// routers generating a configuration file, that can show it without writing it
+type configRenderer interface {
+	renderConfig() ([]byte, error)
+}
+
+// routers supporting dry run only log what they would do
+type dryRunner interface {
+	dryRunChanged() bool
 }
 
 func (r *RouterCommon) commonInit(router Router, synapse *Synapse) error {
@@ -37,6 +77,10 @@ func (r *RouterCommon) commonInit(router Router, synapse *Synapse) error {
 	}
 
 	r.lastEvents = make(map[*Service]*ServiceReport)
+	r.lastReceived = make(map[*Service]ServiceReport)
+	r.pendingEvents = make(map[*Service]ServiceReport)
+	r.watcherContexts = make(map[*Service]*ContextImpl)
+	r.firstRound = make(chan struct{})
 	for _, service := range r.Services {
 		if err := service.Init(router, synapse); err != nil {
 			return errs.WithEF(err, r.fields, "Failed to init service")
@@ -50,29 +94,259 @@ func (r *RouterCommon) RunCommon(context *ContextImpl, router Router) {
 	context.doneWaiter.Add(1)
 	defer context.doneWaiter.Done()
 
-	events := make(chan ServiceReport)
-	watcherContext := newContext(context.oneshot)
+	r.handleMutex.Lock()
+	r.events = make(chan ServiceReport)
+	r.oneshot = context.oneshot
 	for _, service := range r.Services {
-		go service.typedWatcher.Watch(watcherContext, events, service)
+		r.startWatcher(service)
 	}
+	r.handleMutex.Unlock()
 
-	go r.eventsProcessor(events, router)
+	processorDone := make(chan struct{})
+	go func() {
+		r.eventsProcessor(r.events, router)
+		close(processorDone)
+	}()
 
 	<-context.stop
+	r.handleMutex.Lock()
+	for service := range r.watcherContexts {
+		r.stopWatcher(service)
+	}
+	r.handleMutex.Unlock()
+	logs.WithF(r.fields).Debug("All Watchers stopped")
+	close(r.events)
+	<-processorDone
+}
+
+func (r *RouterCommon) startWatcher(service *Service) {
+	watcherContext := newContext(r.oneshot)
+	r.watcherContexts[service] = watcherContext
+	events := r.events
+	// counted before starting, so a stop right after waits for the watcher before events are closed
+	watcherContext.doneWaiter.Add(1)
+	go func() {
+		defer watcherContext.doneWaiter.Done()
+		service.typedWatcher.Watch(watcherContext, events, service)
+	}()
+}
+
+func (r *RouterCommon) stopWatcher(service *Service) {
+	watcherContext, ok := r.watcherContexts[service]
+	if !ok {
+		return
+	}
 	close(watcherContext.stop)
 	watcherContext.doneWaiter.Wait()
-	logs.WithF(r.fields).Debug("All Watchers stopped")
-	close(events)
+	delete(r.watcherContexts, service)
+}
+
+// replace running services by the given ones. Services already running are kept with their watcher
+func (r *RouterCommon) updateServices(router Router, services []*Service) {
+	r.handleMutex.Lock()
+	defer r.handleMutex.Unlock()
+
+	kept := make(map[*Service]struct{})
+	for _, service := range services {
+		kept[service] = struct{}{}
+	}
+
+	for _, service := range r.Services {
+		if _, ok := kept[service]; ok {
+			continue
+		}
+		logs.WithF(service.fields).Info("Removing service")
+		r.stopWatcher(service)
+		delete(r.lastEvents, service)
+		delete(r.lastReceived, service)
+		delete(r.pendingEvents, service)
+		if err := router.removeService(service); err != nil {
+			logs.WithEF(err, service.fields).Error("Failed to remove service from router")
+		}
+	}
+
+	running := make(map[*Service]struct{})
+	for _, service := range r.Services {
+		running[service] = struct{}{}
+	}
+	r.Services = services
+	for _, service := range services {
+		if _, ok := running[service]; ok {
+			continue
+		}
+		logs.WithF(service.fields).Info("Adding service")
+		if r.events != nil {
+			r.startWatcher(service)
+		}
+	}
+}
+
+// parse services of a new router configuration. Services with unchanged configuration are reused
+func (r *RouterCommon) prepareServices(router Router, content []byte) ([]*Service, error) {
+	if problems := validateRouter(content, r.synapse.Zone, r.fields); len(problems) > 0 {
+		return nil, errs.WithF(r.fields, "Invalid router configuration").WithErrs(problems...)
+	}
+	conf := RouterCommon{}
+	if err := json.Unmarshal(content, &conf); err != nil {
+		return nil, errs.WithEF(err, r.fields, "Failed to unmarshall router services")
+	}
+
+	used := make(map[*Service]struct{})
+	services := []*Service{}
+	for _, service := range conf.Services {
+		config, err := json.Marshal(service)
+		if err != nil {
+			return nil, errs.WithEF(err, r.fields, "Failed to marshal service configuration")
+		}
+
+		var existing *Service
+		for _, current := range r.Services {
+			if _, ok := used[current]; !ok && bytes.Equal(current.config, config) {
+				existing = current
+				break
+			}
+		}
+		if existing != nil {
+			used[existing] = struct{}{}
+			services = append(services, existing)
+			continue
+		}
+
+		if err := service.Init(router, r.synapse); err != nil {
+			service.close()
+			r.releaseNewServices(services)
+			return nil, errs.WithEF(err, r.fields, "Failed to init service")
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// release services prepared for a configuration that will not be applied. Running ones are kept
+func (r *RouterCommon) releaseNewServices(services []*Service) {
+	for _, service := range services {
+		if !r.hasService(service) {
+			service.close()
+		}
+	}
+}
+
+// release all services of a router that will not be started
+func releaseRouter(router Router) {
+	for _, service := range router.getCommon().Services {
+		service.close()
+	}
+}
+
+func (r *RouterCommon) hasService(service *Service) bool {
+	for _, s := range r.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// force a server out of rotation until enabled again or removed from discovery.
+// Returns false if the server is unknown, and an error if the override cannot be applied
+func (r *RouterCommon) setServerDisabled(router Router, service *Service, server string, disabled bool) (bool, error) {
+	r.handleMutex.Lock()
+	defer r.handleMutex.Unlock()
+
+	received, ok := r.lastReceived[service]
+	if !ok {
+		return false, nil
+	}
+	found := false
+	for _, report := range received.Reports {
+		if report.Name == server {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	fields := service.fields.WithField("server", server)
+	_, wasDisabled := service.disabledServers[server]
+	revert := func() {
+		if wasDisabled {
+			service.disabledServers[server] = struct{}{}
+		} else {
+			delete(service.disabledServers, server)
+		}
+	}
+	if disabled {
+		logs.WithF(fields).Info("Disabling server")
+		service.disabledServers[server] = struct{}{}
+
+		// a report without enough active servers would be dropped by handleReport
+		check := received
+		service.applyDisabledServers(&check)
+		if available, _ := check.AvailableUnavailable(); !check.HasActiveServers() || available < service.MinimumHosts {
+			revert()
+			return true, errs.WithF(fields.WithField("available", available).WithField("minimum", service.MinimumHosts),
+				"Cannot disable server, service would not have enough active servers")
+		}
+	} else {
+		logs.WithF(fields).Info("Enabling server")
+		delete(service.disabledServers, server)
+	}
+	received.DiscoveryTime = time.Time{} // not a discovery change
+	if err := r.handleReport([]ServiceReport{received}, router); err != nil {
+		revert()
+		return true, errs.WithEF(err, fields, "Failed to apply server override")
+	}
+	return true, nil
+}
+
+// stop applying changes to the router, discovery keeps running
+func (r *RouterCommon) pause() {
+	r.handleMutex.Lock()
+	defer r.handleMutex.Unlock()
+	if !r.paused {
+		logs.WithF(r.fields).Warn("Pausing router updates")
+	}
+	r.paused = true
+}
+
+// apply changes received while paused
+func (r *RouterCommon) resume(router Router) {
+	r.handleMutex.Lock()
+	defer r.handleMutex.Unlock()
+	if !r.paused {
+		return
+	}
+	logs.WithF(r.fields.WithField("pending", len(r.pendingEvents))).Info("Resuming router updates")
+	r.paused = false
+	events := []ServiceReport{}
+	for _, event := range r.pendingEvents {
+		events = append(events, event)
+	}
+	r.pendingEvents = make(map[*Service]ServiceReport)
+	if len(events) > 0 {
+		r.handleReport(events, router)
+	}
+}
+
+func (r *RouterCommon) getCommon() *RouterCommon {
+	return r
 }
 
 func (r *RouterCommon) eventsProcessor(events chan ServiceReport, router Router) {
 	updateMutex := sync.Mutex{}
 	bufEvents := make(map[*Service]*ServiceReport)
 	var eventsTimer *time.Timer
+	runs := sync.WaitGroup{} // scheduled or running deferRun
 
 	deferRun := func() {
-		logs.WithF(r.fields.WithField("events", bufEvents)).Debug("Run events buffer")
+		// only one update at a time, events received meanwhile are merged so the latest report always wins
+		r.handleMutex.Lock()
+		defer r.handleMutex.Unlock()
+
 		updateMutex.Lock()
+		logs.WithF(r.fields.WithField("events", bufEvents)).Debug("Run events buffer")
 		reports := []ServiceReport{}
 		for _, s := range bufEvents {
 			reports = append(reports, *s)
@@ -80,6 +354,9 @@ func (r *RouterCommon) eventsProcessor(events chan ServiceReport, router Router)
 		bufEvents = make(map[*Service]*ServiceReport)
 		updateMutex.Unlock()
 
+		if len(reports) == 0 {
+			return
+		}
 		r.handleReport(reports, router)
 	}
 
@@ -87,6 +364,11 @@ func (r *RouterCommon) eventsProcessor(events chan ServiceReport, router Router)
 		select {
 		case event, ok := <-events:
 			if !ok {
+				// a buffered update must not be applied once the router is stopped, a running one is waited for
+				if eventsTimer != nil && eventsTimer.Stop() {
+					runs.Done()
+				}
+				runs.Wait()
 				return
 			}
 
@@ -94,60 +376,160 @@ func (r *RouterCommon) eventsProcessor(events chan ServiceReport, router Router)
 			if eventsTimer != nil && !eventsTimer.Stop() {
 				logs.WithF(r.fields.WithField("event", event)).Trace("Event Already fired")
 			} else {
+				if eventsTimer != nil {
+					runs.Done()
+				}
 				logs.WithF(r.fields.WithField("event", event)).Trace("Event Added to buffer")
 			}
 
 			updateMutex.Lock()
+			if previous, ok := bufEvents[event.Service]; ok {
+				event.DiscoveryTime = earliestDiscovery(previous.DiscoveryTime, event.DiscoveryTime)
+			}
 			bufEvents[event.Service] = &event
 			updateMutex.Unlock()
-			eventsTimer = time.AfterFunc(time.Duration(r.EventsBufferDurationInMilli)*time.Millisecond, deferRun)
+			runs.Add(1)
+			eventsTimer = time.AfterFunc(time.Duration(r.EventsBufferDurationInMilli)*time.Millisecond, func() {
+				defer runs.Done()
+				deferRun()
+			})
 		}
 	}
 }
 
-func (r *RouterCommon) handleReport(events []ServiceReport, router Router) {
+// applied, dropped or failed, each service got a report handled
+func (r *RouterCommon) checkFirstRound() {
+	if r.paused {
+		return
+	}
+	for _, service := range r.Services {
+		if _, ok := r.lastReceived[service]; !ok {
+			return
+		}
+	}
+	r.firstRoundOnce.Do(func() {
+		close(r.firstRound)
+	})
+}
+
+// reports merged into one are applied as late as the oldest change they contain. Zero is not a discovery
+func earliestDiscovery(a time.Time, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// returns the error of the router update, events dropped are only logged
+func (r *RouterCommon) handleReport(events []ServiceReport, router Router) error {
+	defer r.checkFirstRound()
 	validEvents := []ServiceReport{}
 
 	for _, event := range events {
+		if !r.hasService(event.Service) {
+			logs.WithF(event.Service.fields).Debug("Dropping report of removed service")
+			continue
+		}
+
+		received := event
+		received.Reports = make([]Report, len(event.Reports))
+		copy(received.Reports, event.Reports)
+		r.lastReceived[event.Service] = received
+		if r.paused {
+			if pending, ok := r.pendingEvents[event.Service]; ok {
+				received.DiscoveryTime = earliestDiscovery(pending.DiscoveryTime, received.DiscoveryTime)
+			}
+			r.pendingEvents[event.Service] = received
+			continue
+		}
+		event.Service.applyDisabledServers(&event)
 
-		event.Service.ServerSort.Sort(&event.Reports)
+		event.Service.sortReports(&event.Reports)
 
 		available, unavailable := event.AvailableUnavailable()
 		r.synapse.serviceAvailableCount.WithLabelValues(event.Service.Name).Set(float64(available))
 		r.synapse.serviceUnavailableCount.WithLabelValues(event.Service.Name).Set(float64(unavailable))
 
-		if !event.HasActiveServers() {
+		if ratio := event.Service.MinAvailableRatio; ratio > 0 && len(event.Reports) > 0 && float64(available)/float64(len(event.Reports)) < ratio {
+			logs.WithF(event.Service.fields.WithField("available", available).WithField("total", len(event.Reports)).WithField("minAvailableRatio", ratio)).
+				Error("Available servers below minimum ratio. Disabling all servers of service")
+			event.disableAll()
+		} else if !event.HasActiveServers() {
 			if r.lastEvents[event.Service] == nil {
 				logs.WithF(event.Service.fields).Warn("First Report has no active server. Not declaring in router")
 			} else {
 				logs.WithF(event.Service.fields).Error("Receiving report with no active server. Keeping previous report")
 			}
 			continue
+		} else if available < event.Service.MinimumHosts && r.lastEvents[event.Service] != nil {
+			logs.WithF(event.Service.fields.WithField("available", available).WithField("minimum", event.Service.MinimumHosts)).
+				Warn("Receiving report with less available servers than minimum. Keeping previous report")
+			continue
 		} else if r.lastEvents[event.Service] == nil || r.lastEvents[event.Service].HasActiveServers() != event.HasActiveServers() {
 			logs.WithF(event.Service.fields.WithField("event", event)).Info("Server(s) available for router")
 		}
+		for state, count := range event.serverStates() {
+			r.synapse.backendServers.WithLabelValues(event.Service.Name, state).Set(float64(count))
+		}
 		validEvents = append(validEvents, event)
 	}
 
+	if r.paused {
+		logs.WithF(r.fields).Debug("Router is paused. Keeping change until resumed")
+		return nil
+	}
 	if len(validEvents) == 0 {
 		logs.WithF(r.fields).Debug("Nothing to update on router")
-		return
+		return nil
 	}
 
 	if err := router.Update(validEvents); err != nil {
+		// lastEvents stay the ones applied, so a rejected report is fully applied again when received again
 		r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Inc()
 		logs.WithEF(err, r.fields).Error("Failed to report watch modification")
+		return err
 	}
 
-	for _, e := range validEvents {
-		r.lastEvents[e.Service] = &e
+	for i := range validEvents {
+		if !validEvents[i].DiscoveryTime.IsZero() {
+			r.synapse.routerUpdateDuration.WithLabelValues(r.Type, validEvents[i].Service.Name).Observe(time.Since(validEvents[i].DiscoveryTime).Seconds())
+		}
+		r.lastEvents[validEvents[i].Service] = &validEvents[i]
 	}
+	return nil
 }
 
 func (r *RouterCommon) getFields() data.Fields {
 	return r.fields
 }
 
+// compare router configurations without their services
+func sameRouterConfig(old []byte, new []byte) bool {
+	var oldConf, newConf map[string]interface{}
+	if err := json.Unmarshal(old, &oldConf); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(new, &newConf); err != nil {
+		return false
+	}
+	for _, conf := range []map[string]interface{}{oldConf, newConf} {
+		for k := range conf {
+			if strings.EqualFold(k, "services") {
+				delete(conf, k)
+			}
+		}
+	}
+	oldContent, err := json.Marshal(oldConf)
+	if err != nil {
+		return false
+	}
+	newContent, err := json.Marshal(newConf)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(oldContent, newContent)
+}
+
 func RouterFromJson(content []byte, s *Synapse) (Router, error) {
 	t := &RouterCommon{}
 	if err := json.Unmarshal([]byte(content), t); err != nil {
@@ -155,24 +537,44 @@ func RouterFromJson(content []byte, s *Synapse) (Router, error) {
 	}
 
 	fields := data.WithField("type", t.Type)
-	var typedRouter Router
-	switch t.Type {
-	case "console":
-		typedRouter = NewRouterConsole()
-	case "haproxy":
-		typedRouter = NewRouterHaProxy()
-	case "template":
-		typedRouter = NewRouterTemplate()
-	default:
+	typedRouter := newTypedRouter(t.Type)
+	if typedRouter == nil {
 		return nil, errs.WithF(fields, "Unsupported router type")
 	}
 
+	if _, ok := typedRouter.(dryRunner); s.DryRun && !ok && t.Type != "console" {
+		return nil, errs.WithF(fields, "Dry run is not supported by router")
+	}
+
 	if err := json.Unmarshal([]byte(content), &typedRouter); err != nil {
 		return nil, errs.WithEF(err, fields, "Failed to unmarshall router")
 	}
 
+	if problems := typedRouter.validate(fields); len(problems) > 0 {
+		return nil, errs.WithF(fields, "Invalid router configuration").WithErrs(problems...)
+	}
 	if err := typedRouter.Init(s); err != nil {
+		releaseRouter(typedRouter)
 		return nil, errs.WithEF(err, fields, "Failed to init router")
 	}
 	return typedRouter, nil
 }
+
+// nil if type is not supported
+func newTypedRouter(routerType string) Router {
+	switch routerType {
+	case "console":
+		return NewRouterConsole()
+	case "haproxy":
+		return NewRouterHaProxy()
+	case "nginx":
+		return NewRouterNginx()
+	case "ipvs":
+		return NewRouterIpvs()
+	case "template":
+		return NewRouterTemplate()
+	case "envoy":
+		return NewRouterEnvoy()
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package synapse
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
 	"io"
 	"os"
@@ -31,6 +32,10 @@ func (r *RouterConsole) Init(s *Synapse) error {
 	return nil
 }
 
+func (r *RouterConsole) validate(fields data.Fields) []error {
+	return nil
+}
+
 func (r *RouterConsole) Update(reports []ServiceReport) error {
 	for _, report := range reports {
 		res, err := json.Marshal(report.Reports)
@@ -42,6 +47,10 @@ func (r *RouterConsole) Update(reports []ServiceReport) error {
 	return nil
 }
 
+func (r *RouterConsole) removeService(service *Service) error {
+	return nil
+}
+
 func (r *RouterConsole) ParseServerOptions(data []byte) (interface{}, error) {
 	return nil, nil
 }
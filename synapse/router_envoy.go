@@ -0,0 +1,275 @@
+package synapse
+
+import (
+	"encoding/json"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const envoyEndpointsTypeUrl = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+// serve discovered servers as envoy clusters with the REST-JSON EDS api
+type RouterEnvoy struct {
+	RouterCommon
+	ListenAddress string
+
+	listener      net.Listener
+	assignments   map[string]envoyClusterLoadAssignment
+	clusterNames  map[*Service]string // name the assignment of each service is stored under
+	versionPrefix string              // versions of a previous process must not match
+	version       int
+	mutex         sync.RWMutex
+}
+
+type EnvoyRouterOptions struct {
+	ClusterName string
+}
+
+type envoyDiscoveryRequest struct {
+	VersionInfo   string   `json:"version_info"`
+	ResourceNames []string `json:"resource_names"`
+}
+
+type envoyDiscoveryResponse struct {
+	VersionInfo string                       `json:"version_info"`
+	Resources   []envoyClusterLoadAssignment `json:"resources"`
+	TypeUrl     string                       `json:"type_url"`
+}
+
+type envoyClusterLoadAssignment struct {
+	Type        string                   `json:"@type"`
+	ClusterName string                   `json:"cluster_name"`
+	Endpoints   []envoyLocalityEndpoints `json:"endpoints"`
+}
+
+type envoyLocalityEndpoints struct {
+	LbEndpoints []envoyLbEndpoint `json:"lb_endpoints"`
+}
+
+type envoyLbEndpoint struct {
+	Endpoint            envoyEndpoint `json:"endpoint"`
+	HealthStatus        string        `json:"health_status"`
+	LoadBalancingWeight *int          `json:"load_balancing_weight,omitempty"`
+}
+
+type envoyEndpoint struct {
+	Address envoyAddress `json:"address"`
+}
+
+type envoyAddress struct {
+	SocketAddress *envoySocketAddress `json:"socket_address,omitempty"`
+	Pipe          *envoyPipe          `json:"pipe,omitempty"`
+}
+
+type envoySocketAddress struct {
+	Address   string `json:"address"`
+	PortValue int    `json:"port_value"`
+}
+
+type envoyPipe struct {
+	Path string `json:"path"`
+}
+
+func NewRouterEnvoy() *RouterEnvoy {
+	return &RouterEnvoy{
+		assignments:  make(map[string]envoyClusterLoadAssignment),
+		clusterNames: make(map[*Service]string),
+	}
+}
+
+func (r *RouterEnvoy) Init(s *Synapse) error {
+	if err := r.commonInit(r, s); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to init common router")
+	}
+	r.fields = r.fields.WithField("listen", r.ListenAddress)
+	r.versionPrefix = strconv.FormatInt(time.Now().UnixNano(), 36) + "-"
+	r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Set(0)
+	return nil
+}
+
+func (r *RouterEnvoy) validate(fields data.Fields) []error {
+	problems := []error{}
+	if r.ListenAddress == "" {
+		problems = append(problems, errs.WithF(fields, "ListenAddress is required for envoy router"))
+	}
+
+	// assignments are served by cluster name, a second service would replace the first one
+	names := make(map[string]int)
+	for i, service := range r.Services {
+		options := EnvoyRouterOptions{}
+		if len(service.RouterOptions) > 0 {
+			json.Unmarshal(service.RouterOptions, &options)
+		}
+		name := options.ClusterName
+		if name == "" {
+			name = service.Name
+		}
+		if name == "" {
+			name, _ = validateWatcher(service.Watcher, fields)
+		}
+		if name == "" {
+			continue
+		}
+		if previous, ok := names[name]; ok {
+			problems = append(problems, errs.WithF(fields.WithField("service", i).WithField("cluster", name).WithField("previous", previous), "Duplicate envoy cluster name"))
+		}
+		names[name] = i
+	}
+	return problems
+}
+
+func (r *RouterEnvoy) Run(context *ContextImpl) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+
+	listener, err := net.Listen("tcp", r.ListenAddress)
+	if err != nil {
+		logs.WithEF(err, r.fields).Error("Failed to listen for envoy discovery requests")
+	} else {
+		r.listener = listener
+		mux := http.NewServeMux()
+		mux.HandleFunc("/v3/discovery:endpoints", r.serveEndpoints)
+		go http.Serve(listener, mux)
+		logs.WithF(r.fields).Info("Serving envoy endpoint discovery")
+	}
+
+	r.RunCommon(context, r)
+
+	if r.listener != nil {
+		r.listener.Close()
+	}
+}
+
+func (r *RouterEnvoy) Update(reports []ServiceReport) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, report := range reports {
+		name := r.clusterName(report.Service)
+		if previous, ok := r.clusterNames[report.Service]; ok && previous != name {
+			delete(r.assignments, previous)
+		}
+		r.clusterNames[report.Service] = name
+
+		assignment := envoyClusterLoadAssignment{
+			Type:        envoyEndpointsTypeUrl,
+			ClusterName: name,
+			Endpoints:   []envoyLocalityEndpoints{{LbEndpoints: []envoyLbEndpoint{}}},
+		}
+		for _, server := range report.Reports {
+			assignment.Endpoints[0].LbEndpoints = append(assignment.Endpoints[0].LbEndpoints, toEnvoyEndpoint(server, report.Disabled))
+		}
+		r.assignments[assignment.ClusterName] = assignment
+		r.synapse.routerServerCount.WithLabelValues(r.Type, report.Service.Name).Set(float64(len(report.Reports)))
+	}
+	r.version++
+	return nil
+}
+
+func toEnvoyEndpoint(server Report, disabled bool) envoyLbEndpoint {
+	endpoint := envoyLbEndpoint{HealthStatus: "HEALTHY"}
+	if server.isUnixSocket() {
+		endpoint.Endpoint.Address.Pipe = &envoyPipe{Path: server.SocketPath}
+	} else {
+		endpoint.Endpoint.Address.SocketAddress = &envoySocketAddress{Address: server.Host, PortValue: int(server.Port)}
+	}
+
+	switch {
+	case disabled || (server.Available != nil && !*server.Available):
+		endpoint.HealthStatus = "UNHEALTHY"
+	case server.Weight != nil && *server.Weight == 0:
+		endpoint.HealthStatus = "DRAINING" // envoy weights cannot be 0
+	case server.Weight != nil:
+		weight := int(*server.Weight)
+		endpoint.LoadBalancingWeight = &weight
+	}
+	return endpoint
+}
+
+func (r *RouterEnvoy) clusterName(service *Service) string {
+	if service.typedRouterOptions != nil {
+		if name := service.typedRouterOptions.(EnvoyRouterOptions).ClusterName; name != "" {
+			return name
+		}
+	}
+	return service.Name
+}
+
+// envoy polls with the last version it received, and gets a 304 while nothing changed
+func (r *RouterEnvoy) serveEndpoints(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	request := envoyDiscoveryRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(resp, "Invalid discovery request", http.StatusBadRequest)
+		return
+	}
+
+	r.mutex.RLock()
+	version := r.versionPrefix + strconv.Itoa(r.version)
+	if request.VersionInfo == version {
+		r.mutex.RUnlock()
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	response := envoyDiscoveryResponse{
+		VersionInfo: version,
+		Resources:   []envoyClusterLoadAssignment{},
+		TypeUrl:     envoyEndpointsTypeUrl,
+	}
+	for name, assignment := range r.assignments {
+		if len(request.ResourceNames) == 0 || containsString(request.ResourceNames, name) {
+			response.Resources = append(response.Resources, assignment)
+		}
+	}
+	r.mutex.RUnlock()
+
+	content, err := json.Marshal(response)
+	if err != nil {
+		logs.WithEF(err, r.fields).Error("Failed to marshal discovery response")
+		http.Error(resp, "Failed to marshal discovery response", http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(content)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RouterEnvoy) removeService(service *Service) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if name, ok := r.clusterNames[service]; ok {
+		delete(r.assignments, name)
+		delete(r.clusterNames, service)
+	}
+	r.version++
+	return nil
+}
+
+func (r *RouterEnvoy) ParseServerOptions(data []byte) (interface{}, error) {
+	return nil, nil
+}
+
+func (r *RouterEnvoy) ParseRouterOptions(data []byte) (interface{}, error) {
+	routerOptions := EnvoyRouterOptions{}
+	if err := json.Unmarshal(data, &routerOptions); err != nil {
+		return nil, errs.WithEF(err, r.fields.WithField("content", string(data)), "Failed to Unmarshal routerOptions")
+	}
+	return routerOptions, nil
+}
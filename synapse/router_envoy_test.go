@@ -0,0 +1,64 @@
+package synapse
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testEnvoyRouter(clusters ...string) string {
+	services := []string{}
+	for i, cluster := range clusters {
+		services = append(services, `{"name":"api`+strconv.Itoa(i+1)+`","routerOptions":{"clusterName":"`+cluster+`"},"watcher":`+testWatcher+`}`)
+	}
+	return `{"type":"envoy","listenAddress":"127.0.0.1:0","services":[` + strings.Join(services, ",") + `]}`
+}
+
+func TestEnvoyDuplicateClusterNames(t *testing.T) {
+	if problems := validateRouter([]byte(testEnvoyRouter("api", "web")), "", nil); len(problems) > 0 {
+		t.Errorf("Expected distinct cluster names to be valid, got %v", problems)
+	}
+	if problems := validateRouter([]byte(testEnvoyRouter("api", "api")), "", nil); len(problems) != 1 {
+		t.Errorf("Expected duplicate cluster name to be rejected, got %v", problems)
+	}
+	nameAndCluster := `{"type":"envoy","listenAddress":"127.0.0.1:0","services":[{"name":"api","watcher":` + testWatcher + `},
+		{"name":"web","routerOptions":{"clusterName":"api"},"watcher":` + testWatcher + `}]}`
+	if problems := validateRouter([]byte(nameAndCluster), "", nil); len(problems) != 1 {
+		t.Errorf("Expected cluster name of a service name to be rejected, got %v", problems)
+	}
+
+	router := newTestRouter(t, newTestSynapse(), testEnvoyRouter("api"))
+	if _, err := router.getCommon().prepareServices(router, []byte(testEnvoyRouter("api", "api"))); err == nil {
+		t.Errorf("Expected reloaded services with duplicate cluster names to be rejected")
+	}
+}
+
+func TestEnvoyRenamedClusterReplacesPrevious(t *testing.T) {
+	router := newTestRouter(t, newTestSynapse(), testEnvoyRouter("api", "web")).(*RouterEnvoy)
+	common := router.getCommon()
+	update := func() {
+		for _, service := range common.Services {
+			if err := common.handleReport([]ServiceReport{{Service: service, Reports: []Report{testServer("server1", "10.0.0.1", 80)}}}, router); err != nil {
+				t.Fatalf("Failed to apply report: %s", err)
+			}
+		}
+	}
+	update()
+
+	services, err := common.prepareServices(router, []byte(testEnvoyRouter("api-v2", "web")))
+	if err != nil {
+		t.Fatalf("Failed to prepare services: %s", err)
+	}
+	common.updateServices(router, services)
+	update()
+
+	names := []string{}
+	for name := range router.assignments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "api-v2,web" {
+		t.Errorf("Expected clusters api-v2,web, got %s", strings.Join(names, ","))
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
 	"math/rand"
+	"os"
 	"strconv"
 	"strings"
 	"text/template"
@@ -21,8 +22,28 @@ type RouterHaProxy struct {
 	HaProxyClient
 }
 type HapRouterOptions struct {
-	Frontend []string
-	Backend  []string
+	Frontend     []string
+	Backend      []string
+	StickyCookie string
+	Mode         string
+	HttpCheck    *HapHttpCheck
+	Tls          *HapTls
+	DoWrites     *bool
+	DoReloads    *bool
+	DoSocket     *bool
+	// report weights are percentages of this weight instead of absolute weights. 0 to disable
+	WeightPercentOf int
+}
+type HapHttpCheck struct {
+	Method string
+	Uri    string
+}
+type HapTls struct {
+	Bind          string
+	Certificates  []string
+	Alpn          []string
+	Ciphers       string
+	RedirectHttps bool
 }
 type HapServerOptionsTemplate struct {
 	*template.Template
@@ -41,27 +62,74 @@ func (r *RouterHaProxy) Init(s *Synapse) error {
 	if err := r.commonInit(r, s); err != nil {
 		return errs.WithEF(err, r.RouterCommon.fields, "Failed to init common router")
 	}
+	r.dryRun = s.DryRun
 	if err := r.HaProxyClient.Init(); err != nil {
 		return errs.WithEF(err, r.RouterCommon.fields, "Failed to init haproxy client")
 	}
 
+	r.reloads = r.synapse.routerReloads.WithLabelValues(r.Type)
+	r.socketCommands = r.synapse.routerSocketCommands.WithLabelValues(r.Type)
+	r.configWrites = r.synapse.routerConfigWrites.WithLabelValues(r.Type)
+	r.listenFailures = r.synapse.routerListenFailures.WithLabelValues(r.Type)
+	r.reloadsOnHoldGauge = r.synapse.routerReloadsOnHold.WithLabelValues(r.Type)
+	r.reloadsOnHoldGauge.Set(0)
+
 	r.synapse.routerUpdateFailures.WithLabelValues(r.Type + PrometheusLabelSocketSuffix).Set(0)
 	r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Set(0)
 
-	if r.ConfigPath == "" {
-		return errs.WithF(r.RouterCommon.fields, "ConfigPath is required for haproxy router")
+	names := []string{}
+	for _, service := range r.Services {
+		names = append(names, service.Name+"_"+strconv.Itoa(service.id))
 	}
-	if len(r.ReloadCommand) == 0 {
-		return errs.WithF(r.RouterCommon.fields, "ReloadCommand is required for haproxy router")
+	if err := r.loadState(names); err != nil {
+		r.synapse.routerStateLoadFailures.WithLabelValues(r.Type).Inc()
+		logs.WithEF(err, r.RouterCommon.fields).Warn("Failed to load haproxy state")
 	}
 
 	return nil
 }
 
+func (r *RouterHaProxy) validate(fields data.Fields) []error {
+	return append(r.HaProxyClient.validate(fields), r.validateTlsBinds(fields)...)
+}
+
+// each tls frontend needs its own bind, so the :443 default is only for a single tls service
+func (r *RouterHaProxy) validateTlsBinds(fields data.Fields) []error {
+	binds := []string{}
+	for _, service := range r.Services {
+		options := struct {
+			Tls *struct {
+				Bind string
+			}
+		}{}
+		if len(service.RouterOptions) == 0 || json.Unmarshal(service.RouterOptions, &options) != nil || options.Tls == nil {
+			continue
+		}
+		binds = append(binds, options.Tls.Bind)
+	}
+	if len(binds) < 2 {
+		return nil
+	}
+
+	problems := []error{}
+	used := make(map[string]struct{})
+	for _, bind := range binds {
+		if bind == "" {
+			problems = append(problems, errs.WithF(fields, "Tls bind is required when several services enable tls"))
+			continue
+		}
+		if _, ok := used[bind]; ok {
+			problems = append(problems, errs.WithF(fields.WithField("bind", bind), "Tls bind used by several services"))
+		}
+		used[bind] = struct{}{}
+	}
+	return problems
+}
+
 func (r *RouterHaProxy) isSocketUpdatable(report ServiceReport) bool {
 	previous := r.lastEvents[report.Service]
 
-	if previous == nil || len(previous.Reports) != len(report.Reports) {
+	if previous == nil || len(previous.Reports) != len(report.Reports) || previous.Disabled != report.Disabled {
 		return false
 	}
 
@@ -71,7 +139,9 @@ func (r *RouterHaProxy) isSocketUpdatable(report ServiceReport) bool {
 			if new.Host == old.Host &&
 				new.Port == old.Port &&
 				new.Name == old.Name &&
-				new.HaProxyServerOptions == old.HaProxyServerOptions {
+				new.HaProxyServerOptions == old.HaProxyServerOptions &&
+				(new.Weight == nil) == (old.Weight == nil) && // a server line without weight cannot be updated by socket
+				new.ServerReport.Equals(old.ServerReport) {
 				weightOnly = true
 				break
 			}
@@ -85,37 +155,249 @@ func (r *RouterHaProxy) isSocketUpdatable(report ServiceReport) bool {
 	return true
 }
 
+// disable or enable servers forced by api since last report. Other servers are left as they are in haproxy
+func (r *RouterHaProxy) serverStateCommands(backend string, report ServiceReport) []string {
+	previous := make(map[string]bool)
+	for _, old := range r.lastEvents[report.Service].Reports {
+		previous[old.Name] = old.disabled
+	}
+	commands := []string{}
+	for _, server := range report.Reports {
+		if server.disabled == previous[server.Name] {
+			continue
+		}
+		if server.disabled {
+			commands = append(commands, "disable server "+backend+"/"+server.Name)
+		} else {
+			commands = append(commands, "enable server "+backend+"/"+server.Name)
+		}
+	}
+	return commands
+}
+
+// what a service change is allowed to do. Router values, overridden by routerOptions
+type hapServiceActions struct {
+	doWrites  bool
+	doReloads bool
+	doSocket  bool
+}
+
+func (r *RouterHaProxy) serviceActions(service *Service) hapServiceActions {
+	actions := hapServiceActions{
+		doWrites:  *r.DoWrites,
+		doReloads: *r.DoReloads,
+		doSocket:  *r.DoSocket,
+	}
+	if service.typedRouterOptions == nil {
+		return actions
+	}
+	routerOptions := service.typedRouterOptions.(HapRouterOptions)
+	if routerOptions.DoWrites != nil {
+		actions.doWrites = *routerOptions.DoWrites
+	}
+	if routerOptions.DoReloads != nil {
+		actions.doReloads = *routerOptions.DoReloads
+	}
+	if routerOptions.DoSocket != nil {
+		actions.doSocket = *routerOptions.DoSocket
+	}
+	return actions
+}
+
+// actions allowed to at least one service, router values without service
+func (r *RouterHaProxy) allServicesActions() hapServiceActions {
+	if len(r.Services) == 0 {
+		return r.serviceActions(&Service{})
+	}
+	actions := hapServiceActions{}
+	for _, service := range r.Services {
+		serviceActions := r.serviceActions(service)
+		actions.doWrites = actions.doWrites || serviceActions.doWrites
+		actions.doReloads = actions.doReloads || serviceActions.doReloads
+		actions.doSocket = actions.doSocket || serviceActions.doSocket
+	}
+	return actions
+}
+
+type hapSnapshot struct {
+	frontend map[string][]string
+	backend  map[string][]string
+}
+
 func (r *RouterHaProxy) Update(serviceReports []ServiceReport) error {
-	reloadNeeded := r.socketPath == ""
+	var writeNeeded, reloadNeeded, socketNeeded, reloadFallback bool
+	stateCommands := []string{}
+	snapshot := hapSnapshot{
+		frontend: make(map[string][]string),
+		backend:  make(map[string][]string),
+	}
 	for _, report := range serviceReports {
 		front, back, err := r.toFrontendAndBackend(report)
 		if err != nil {
+			r.restore(snapshot)
 			return errs.WithEF(err, r.RouterCommon.fields.WithField("report", report), "Failed to prepare frontend and backend")
 		}
-		r.Frontend[report.Service.Name+"_"+strconv.Itoa(report.Service.id)] = front
-		r.Backend[report.Service.Name+"_"+strconv.Itoa(report.Service.id)] = back
-		if !r.isSocketUpdatable(report) {
+		name := report.Service.Name + "_" + strconv.Itoa(report.Service.id)
+		snapshot.frontend[name] = r.Frontend[name]
+		snapshot.backend[name] = r.Backend[name]
+		r.Frontend[name] = front
+		r.Backend[name] = back
+
+		actions := r.serviceActions(report.Service)
+		if len(r.SocketAddresses) > 0 && actions.doSocket && r.isSocketUpdatable(report) {
+			stateCommands = append(stateCommands, r.serverStateCommands(name, report)...)
+			socketNeeded = true
+			reloadFallback = reloadFallback || actions.doReloads
+			writeNeeded = writeNeeded || actions.doWrites
+		} else if actions.doReloads {
 			reloadNeeded = true
+			writeNeeded = writeNeeded || actions.doWrites
+		} else if actions.doWrites {
+			writeNeeded = true
+		} else {
+			logs.WithF(r.RouterCommon.fields.WithField("service", report.Service.Name)).Debug("Writes, reloads and socket are disabled for service. Not applying change")
 		}
+		r.synapse.routerServerCount.WithLabelValues(r.Type, report.Service.Name).Set(float64(len(report.Reports)))
 	}
 
 	if reloadNeeded {
-		if err := r.Reload(); err != nil {
+		if err := r.reload(writeNeeded); err != nil {
+			r.restore(snapshot)
 			return errs.WithEF(err, r.RouterCommon.fields, "Failed to reload haproxy")
 		}
-	} else if err := r.SocketUpdate(); err != nil {
-		r.synapse.routerUpdateFailures.WithLabelValues(r.Type + PrometheusLabelSocketSuffix).Inc()
-		logs.WithEF(err, r.RouterCommon.fields).Error("Update by Socket failed. Reloading instead")
-		if err := r.Reload(); err != nil {
+	} else if socketNeeded {
+		if err := r.socketUpdate(writeNeeded, stateCommands...); err != nil {
+			r.synapse.routerUpdateFailures.WithLabelValues(r.Type + PrometheusLabelSocketSuffix).Inc()
+			if !reloadFallback {
+				r.restore(snapshot)
+				return errs.WithEF(err, r.RouterCommon.fields, "Update by Socket failed and reloads are disabled")
+			}
+			logs.WithEF(err, r.RouterCommon.fields).Error("Update by Socket failed. Reloading instead")
+			if err := r.reload(writeNeeded); err != nil {
+				r.restore(snapshot)
+				return errs.WithEF(err, r.RouterCommon.fields, "Failed to reload haproxy")
+			}
+		}
+	} else if writeNeeded {
+		if err := r.writeConfig(); err != nil {
+			r.restore(snapshot)
+			return errs.WithEF(err, r.RouterCommon.fields, "Failed to write haproxy configuration")
+		}
+	}
+
+	if err := r.saveState(r.hasMinimumServers(serviceReports)); err != nil {
+		logs.WithEF(err, r.RouterCommon.fields).Warn("Failed to save haproxy state")
+	}
+	return nil
+}
+
+// true if every service has at least its minimum of active servers, in reports being applied or last applied ones
+func (r *RouterHaProxy) hasMinimumServers(serviceReports []ServiceReport) bool {
+	applied := make(map[*Service]*ServiceReport)
+	for service, report := range r.lastEvents {
+		applied[service] = report
+	}
+	for i := range serviceReports {
+		applied[serviceReports[i].Service] = &serviceReports[i]
+	}
+	for _, service := range r.Services {
+		report, ok := applied[service]
+		if !ok {
+			return false
+		}
+		if available, _ := report.AvailableUnavailable(); available == 0 || available < service.MinimumHosts {
+			return false
+		}
+	}
+	return true
+}
+
+// configuration as it is written, whatever doWrites
+func (r *RouterHaProxy) renderConfig() ([]byte, error) {
+	r.handleMutex.Lock()
+	defer r.handleMutex.Unlock()
+	return r.templateConfig()
+}
+
+// write and reload with current servers, as far as doWrites and doReloads allow it. Returns the action done
+func (r *RouterHaProxy) forceReload() (string, error) {
+	r.handleMutex.Lock()
+	defer r.handleMutex.Unlock()
+
+	actions := r.allServicesActions()
+	switch {
+	case actions.doReloads:
+		r.releaseReloadHold()
+		if err := r.reload(actions.doWrites); err != nil {
+			return "", errs.WithEF(err, r.RouterCommon.fields, "Failed to reload haproxy")
+		}
+		if actions.doWrites {
+			return "written and reloaded", nil
+		}
+		return "reloaded", nil
+	case actions.doWrites:
+		if err := r.writeConfig(); err != nil {
+			return "", errs.WithEF(err, r.RouterCommon.fields, "Failed to write haproxy configuration")
+		}
+		return "written", nil
+	default:
+		return "nothing, writes and reloads are disabled", nil
+	}
+}
+
+func (r *RouterHaProxy) removeService(service *Service) error {
+	name := service.Name + "_" + strconv.Itoa(service.id)
+	delete(r.Frontend, name)
+	delete(r.Backend, name)
+	actions := r.serviceActions(service)
+	if actions.doReloads {
+		if err := r.reload(actions.doWrites); err != nil {
 			return errs.WithEF(err, r.RouterCommon.fields, "Failed to reload haproxy")
 		}
+	} else if actions.doWrites {
+		if err := r.writeConfig(); err != nil {
+			return errs.WithEF(err, r.RouterCommon.fields, "Failed to write haproxy configuration")
+		}
+	} else {
+		logs.WithF(r.RouterCommon.fields.WithField("service", service.Name)).Debug("Writes and reloads are disabled for service. Not applying removal")
+	}
+	// last good state is written again with next update
+	if err := r.saveState(false); err != nil {
+		logs.WithEF(err, r.RouterCommon.fields).Warn("Failed to save haproxy state")
 	}
 	return nil
 }
 
+// put back frontends and backends as they were before a failed update, to stay in sync with lastEvents
+func (r *RouterHaProxy) restore(snapshot hapSnapshot) {
+	for name, front := range snapshot.frontend {
+		if front == nil {
+			delete(r.Frontend, name)
+		} else {
+			r.Frontend[name] = front
+		}
+	}
+	for name, back := range snapshot.backend {
+		if back == nil {
+			delete(r.Backend, name)
+		} else {
+			r.Backend[name] = back
+		}
+	}
+}
+
 func (r *RouterHaProxy) toFrontendAndBackend(report ServiceReport) ([]string, []string, error) {
 	frontend := []string{}
 	if report.Service.typedRouterOptions != nil {
+		if mode := report.Service.typedRouterOptions.(HapRouterOptions).Mode; mode != "" {
+			frontend = append(frontend, "mode "+mode)
+		}
+		if tls := report.Service.typedRouterOptions.(HapRouterOptions).Tls; tls != nil {
+			frontend = append(frontend, tls.bindLine())
+			if tls.RedirectHttps {
+				frontend = append(frontend, "http-request redirect scheme https unless { ssl_fc }")
+			}
+		}
 		for _, option := range report.Service.typedRouterOptions.(HapRouterOptions).Frontend {
 			frontend = append(frontend, option)
 		}
@@ -123,42 +405,100 @@ func (r *RouterHaProxy) toFrontendAndBackend(report ServiceReport) ([]string, []
 	frontend = append(frontend, "default_backend "+report.Service.Name+"_"+strconv.Itoa(report.Service.id))
 
 	backend := []string{}
+	stickyCookie := ""
 	if report.Service.typedRouterOptions != nil {
-		for _, option := range report.Service.typedRouterOptions.(HapRouterOptions).Backend {
+		routerOptions := report.Service.typedRouterOptions.(HapRouterOptions)
+		if routerOptions.Mode != "" {
+			backend = append(backend, "mode "+routerOptions.Mode)
+		}
+		if routerOptions.HttpCheck != nil {
+			backend = append(backend, "option httpchk "+routerOptions.HttpCheck.Method+" "+routerOptions.HttpCheck.Uri)
+		}
+		for _, option := range routerOptions.Backend {
 			backend = append(backend, option)
 		}
+		stickyCookie = routerOptions.StickyCookie
+	}
+	if stickyCookie != "" {
+		backend = append(backend, "cookie "+stickyCookie+" insert indirect nocache")
 	}
 
+	weightPercentOf := 0
+	if report.Service.typedRouterOptions != nil {
+		weightPercentOf = report.Service.typedRouterOptions.(HapRouterOptions).WeightPercentOf
+	}
 	var serverOptions HapServerOptionsTemplate
 	if report.Service.typedServerOptions != nil {
 		serverOptions = report.Service.typedServerOptions.(HapServerOptionsTemplate)
 	}
+	serviceReport := report
 	for _, report := range report.Reports {
-		server, err := r.reportToHaProxyServer(report, serverOptions)
+		server, err := r.reportToHaProxyServer(report, serverOptions, weightPercentOf)
 		if err != nil {
 			return nil, nil, errs.WithEF(err, r.RouterCommon.fields.WithField("name", report.Name), "Failed to prepare backend for server")
 		}
+		if stickyCookie != "" {
+			server += " cookie " + report.Name
+		}
+		if serviceReport.Disabled || report.disabled {
+			server += " disabled"
+		}
 		backend = append(backend, server)
 	}
 
 	return frontend, backend, nil
 }
 
-func (r *RouterHaProxy) reportToHaProxyServer(report Report, serverOptions HapServerOptionsTemplate) (string, error) {
+func (tls *HapTls) bindLine() string {
+	line := "bind " + tls.Bind + " ssl"
+	for _, certificate := range tls.Certificates {
+		line += " crt " + certificate
+	}
+	if len(tls.Alpn) > 0 {
+		line += " alpn " + strings.Join(tls.Alpn, ",")
+	}
+	if tls.Ciphers != "" {
+		line += " ciphers " + tls.Ciphers
+	}
+	return line
+}
+
+func (r *RouterHaProxy) reportToHaProxyServer(report Report, serverOptions HapServerOptionsTemplate, weightPercentOf int) (string, error) {
 	var buffer bytes.Buffer
 	buffer.WriteString("server ")
 	buffer.WriteString(report.Name)
 	buffer.WriteString(" ")
-	buffer.WriteString(report.Host)
-	buffer.WriteString(":")
-	buffer.WriteString(strconv.Itoa(int(report.Port)))
+	buffer.WriteString(report.address())
 	buffer.WriteString(" ")
 	if report.Weight != nil {
 		buffer.WriteString("weight ")
-		buffer.WriteString(strconv.Itoa(int(*report.Weight)))
+		buffer.WriteString(strconv.Itoa(percentToWeight(int(*report.Weight), weightPercentOf)))
+	}
+	if report.MaxConn != nil {
+		buffer.WriteString(" maxconn ")
+		buffer.WriteString(strconv.Itoa(*report.MaxConn))
+	}
+	if report.Check {
+		buffer.WriteString(" check")
+		if report.CheckInter != nil {
+			buffer.WriteString(" inter ")
+			buffer.WriteString(strconv.Itoa(*report.CheckInter))
+		}
+		if report.CheckRise != nil {
+			buffer.WriteString(" rise ")
+			buffer.WriteString(strconv.Itoa(*report.CheckRise))
+		}
+		if report.CheckFall != nil {
+			buffer.WriteString(" fall ")
+			buffer.WriteString(strconv.Itoa(*report.CheckFall))
+		}
 	}
 	buffer.WriteString(" ")
-	buffer.WriteString(report.HaProxyServerOptions)
+	reportOptions, err := renderReportServerOptions(report)
+	if err != nil {
+		return "", errs.WithEF(err, r.RouterCommon.fields.WithField("options", report.HaProxyServerOptions), "Failed to template server haproxy options")
+	}
+	buffer.WriteString(reportOptions)
 
 	res, err := renderServerOptionsTemplate(report, serverOptions)
 	if err != nil {
@@ -170,6 +510,41 @@ func (r *RouterHaProxy) reportToHaProxyServer(report Report, serverOptions HapSe
 	return buffer.String(), nil
 }
 
+// absolute weight from a percentage of base. A non zero percentage never gives weight 0, that would drain the server
+func percentToWeight(weight int, base int) int {
+	if base <= 0 {
+		return weight
+	}
+	if weight > 100 {
+		weight = 100
+	}
+	res := (weight*base + 50) / 100
+	if res == 0 && weight > 0 {
+		res = 1
+	}
+	return res
+}
+
+// options reported by the server are templated with the report as context. Options without action are kept as is
+func renderReportServerOptions(report Report) (string, error) {
+	if !strings.Contains(report.HaProxyServerOptions, "{{") {
+		return report.HaProxyServerOptions, nil
+	}
+	tmpl, err := template.New("haproxyServerOptions").Funcs(TemplateFunctions).Parse(report.HaProxyServerOptions)
+	if err != nil {
+		return "", errs.WithE(err, "Failed to parse haproxyServerOptions template")
+	}
+	var buff bytes.Buffer
+	if err := tmpl.Execute(&buff, report); err != nil {
+		return "", errs.WithE(err, "Failed to template haproxyServerOptions")
+	}
+	res := buff.String()
+	if strings.Contains(res, "<no value>") {
+		return "", errs.WithF(data.WithField("content", res), "haproxyServerOptions templating has <no value>")
+	}
+	return res, nil
+}
+
 func renderServerOptionsTemplate(report Report, serverOptions HapServerOptionsTemplate) (string, error) {
 	if serverOptions.Template == nil {
 		return "", nil
@@ -210,13 +585,55 @@ func (r *RouterHaProxy) ParseServerOptions(data []byte) (interface{}, error) {
 
 func (r *RouterHaProxy) ParseRouterOptions(data []byte) (interface{}, error) {
 	routerOptions := HapRouterOptions{}
+	fields := r.RouterCommon.fields.WithField("content", string(data))
 	err := json.Unmarshal(data, &routerOptions)
 	if err != nil {
-		return nil, errs.WithEF(err, r.RouterCommon.fields.WithField("content", string(data)), "Failed to Unmarshal routerOptions")
+		return nil, errs.WithEF(err, fields, "Failed to Unmarshal routerOptions")
+	}
+
+	if routerOptions.Mode != "" && routerOptions.Mode != "tcp" && routerOptions.Mode != "http" {
+		return nil, errs.WithF(fields.WithField("mode", routerOptions.Mode), "Unsupported haproxy mode")
+	}
+	if routerOptions.HttpCheck != nil {
+		if routerOptions.Mode != "http" {
+			return nil, errs.WithF(fields, "httpCheck requires http mode")
+		}
+		if routerOptions.HttpCheck.Method == "" {
+			routerOptions.HttpCheck.Method = "GET"
+		}
+		if routerOptions.HttpCheck.Uri == "" {
+			routerOptions.HttpCheck.Uri = "/"
+		}
+	}
+	if routerOptions.Tls != nil {
+		if err := routerOptions.Tls.validate(routerOptions.Mode); err != nil {
+			return nil, errs.WithEF(err, fields, "Invalid tls")
+		}
+	}
+	if routerOptions.WeightPercentOf < 0 || routerOptions.WeightPercentOf > 256 {
+		return nil, errs.WithF(fields.WithField("weightPercentOf", routerOptions.WeightPercentOf), "weightPercentOf must be between 0 and 256")
 	}
 	return routerOptions, nil
 }
 
+func (tls *HapTls) validate(mode string) error {
+	if tls.Bind == "" {
+		tls.Bind = ":443"
+	}
+	if len(tls.Certificates) == 0 {
+		return errs.With("At least one certificate is required")
+	}
+	for _, certificate := range tls.Certificates {
+		if _, err := os.Stat(certificate); err != nil {
+			return errs.WithEF(err, data.WithField("certificate", certificate), "Certificate not found")
+		}
+	}
+	if tls.RedirectHttps && mode != "http" {
+		return errs.With("redirectHttps requires http mode")
+	}
+	return nil
+}
+
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 const (
 	letterIdxBits = 6                    // 6 bits to represent a letter index
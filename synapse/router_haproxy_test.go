@@ -0,0 +1,586 @@
+package synapse
+
+import (
+	"github.com/samuel/go-zookeeper/zk"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSetServerDisabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		servers  []string
+		disable  []string
+		enable   []string
+		err      bool
+		config   string
+		commands []string
+	}{
+		{
+			name:     "disable",
+			servers:  []string{"api1", "api2"},
+			disable:  []string{"api1"},
+			config:   " disabled",
+			commands: []string{"disable server api_ID/api1"},
+		},
+		{
+			name:     "enable again",
+			servers:  []string{"api1", "api2"},
+			disable:  []string{"api1"},
+			enable:   []string{"api1"},
+			commands: []string{"disable server api_ID/api1", "enable server api_ID/api1"},
+		},
+		{
+			name:     "last active server",
+			servers:  []string{"api1", "api2"},
+			disable:  []string{"api1", "api2"},
+			err:      true,
+			config:   " disabled",
+			commands: []string{"disable server api_ID/api1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			listener, commands := testSocket(t, "unix", dir+"/haproxy.sock")
+			defer listener.Close()
+			router := newTestHaProxy(t, dir, `"socketAddress":"`+dir+`/haproxy.sock",`, "")
+			common := router.getCommon()
+			service := common.Services[0]
+			backend := "api_" + strconv.Itoa(service.id)
+
+			report := ServiceReport{Service: service}
+			for i, name := range test.servers {
+				server := testServer(name, "10.0.0."+strconv.Itoa(i+1), 80)
+				server.Weight = testWeight(100)
+				report.Reports = append(report.Reports, server)
+			}
+			if err := common.handleReport([]ServiceReport{report}, router); err != nil {
+				t.Fatalf("Failed to apply report: %s", err)
+			}
+
+			var err error
+			for _, server := range test.disable {
+				if _, err = common.setServerDisabled(router, service, server, true); err != nil {
+					break
+				}
+			}
+			if (err != nil) != test.err {
+				t.Fatalf("Expected error %t, got %v", test.err, err)
+			}
+			for _, server := range test.enable {
+				if _, err := common.setServerDisabled(router, service, server, false); err != nil {
+					t.Fatalf("Failed to enable server: %s", err)
+				}
+			}
+
+			config := readTestFile(t, dir+"/haproxy.cfg")
+			if strings.Count(config, " disabled") != strings.Count(test.config, " disabled") {
+				t.Errorf("Expected %d disabled servers in configuration:\n%s", strings.Count(test.config, " disabled"), config)
+			}
+			received := []string{}
+			for len(commands) > 0 {
+				for _, command := range strings.Split(<-commands, "; ") {
+					if !strings.HasPrefix(command, "set weight") {
+						received = append(received, command)
+					}
+				}
+			}
+			expected := strings.Replace(strings.Join(test.commands, ","), "api_ID", backend, -1)
+			if strings.Join(received, ",") != expected {
+				t.Errorf("Expected socket commands '%s', got '%s'", expected, strings.Join(received, ","))
+			}
+		})
+	}
+}
+
+// backend lines of a service report rendered by the router, with single spaces between words
+func testBackend(t *testing.T, router *RouterHaProxy, report ServiceReport) []string {
+	report.Service = router.getCommon().Services[0]
+	_, backend, err := router.toFrontendAndBackend(report)
+	if err != nil {
+		t.Fatalf("Failed to render backend: %s", err)
+	}
+	for i := range backend {
+		backend[i] = strings.Join(strings.Fields(backend[i]), " ")
+	}
+	return backend
+}
+
+func TestBackupServers(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  string
+		disabled bool
+		expected []string
+	}{
+		{
+			name:     "discovered servers are never backup",
+			expected: []string{"server api1 10.0.0.1:80", "server api2 10.0.0.2:80"},
+		},
+		{
+			name:    "static backup before discovered servers",
+			service: `"routerOptions":{"backend":["server fallback 10.0.0.9:8080 backup"]},`,
+			expected: []string{"server fallback 10.0.0.9:8080 backup",
+				"server api1 10.0.0.1:80", "server api2 10.0.0.2:80"},
+		},
+		{
+			name:     "disabled discovered servers, static backup stays enabled",
+			service:  `"routerOptions":{"backend":["server fallback 10.0.0.9:8080 backup"]},`,
+			disabled: true,
+			expected: []string{"server fallback 10.0.0.9:8080 backup",
+				"server api1 10.0.0.1:80 weight 0 disabled", "server api2 10.0.0.2:80 weight 0 disabled"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestHaProxy(t, dir, "", test.service)
+
+			report := ServiceReport{Reports: []Report{testServer("api1", "10.0.0.1", 80), testServer("api2", "10.0.0.2", 80)}}
+			if test.disabled {
+				report.disableAll()
+			}
+			if backend := testBackend(t, router, report); strings.Join(backend, "|") != strings.Join(test.expected, "|") {
+				t.Errorf("Expected backend:\n%s\ngot:\n%s", strings.Join(test.expected, "\n"), strings.Join(backend, "\n"))
+			}
+		})
+	}
+}
+
+func TestServerAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		expected string
+	}{
+		{name: "ipv4", host: "10.0.0.1", expected: "server api1 10.0.0.1:80"},
+		{name: "ipv6", host: "2001:db8::1", expected: "server api1 [2001:db8::1]:80"},
+		{name: "hostname", host: "api1.local", expected: "server api1 api1.local:80"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestHaProxy(t, dir, "", "")
+
+			backend := testBackend(t, router, ServiceReport{Reports: []Report{testServer("api1", test.host, 80)}})
+			if strings.Join(backend, "|") != test.expected {
+				t.Errorf("Expected backend '%s', got '%s'", test.expected, strings.Join(backend, "|"))
+			}
+		})
+	}
+}
+
+func TestRouterDefaultServerOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		router   string
+		service  string
+		expected string
+	}{
+		{name: "no options", expected: "server api1 10.0.0.1:80"},
+		{name: "router default", router: `"serverOptions":"check inter 2s fall 3 rise 2",`, expected: "server api1 10.0.0.1:80 check inter 2s fall 3 rise 2"},
+		{name: "service options win", router: `"serverOptions":"check inter 2s fall 3 rise 2",`, service: `"serverOptions":"check inter 5s",`,
+			expected: "server api1 10.0.0.1:80 check inter 5s"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestHaProxy(t, dir, test.router, test.service)
+
+			backend := testBackend(t, router, ServiceReport{Reports: []Report{testServer("api1", "10.0.0.1", 80)}})
+			if strings.Join(backend, "|") != test.expected {
+				t.Errorf("Expected backend '%s', got '%s'", test.expected, strings.Join(backend, "|"))
+			}
+		})
+	}
+}
+
+func TestZeroWeightDrains(t *testing.T) {
+	tests := []struct {
+		name     string
+		weight   *uint8
+		expected []string
+	}{
+		{name: "no weight keeps haproxy default", expected: []string{"server api1 10.0.0.1:80", "server api2 10.0.0.2:80"}},
+		{name: "zero weight stays in backend", weight: testWeight(0), expected: []string{"server api1 10.0.0.1:80 weight 0", "server api2 10.0.0.2:80"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestHaProxy(t, dir, "", `"serverSort":"name",`)
+
+			api1 := testServer("api1", "10.0.0.1", 80)
+			api1.Weight = test.weight
+			backend := testBackend(t, router, ServiceReport{Reports: []Report{api1, testServer("api2", "10.0.0.2", 80)}})
+			if strings.Join(backend, "|") != strings.Join(test.expected, "|") {
+				t.Errorf("Expected backend:\n%s\ngot:\n%s", strings.Join(test.expected, "\n"), strings.Join(backend, "\n"))
+			}
+		})
+	}
+
+	t.Run("drained by socket, removed by reload", func(t *testing.T) {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		listener, commands := testSocket(t, "unix", dir+"/haproxy.sock")
+		defer listener.Close()
+		router := newTestHaProxy(t, dir, `"socketAddress":"`+dir+`/haproxy.sock","reloadCommand":["sh","-c","echo >> `+dir+`/reloads"],`, "")
+		common := router.getCommon()
+		service := common.Services[0]
+
+		api2 := testServer("api2", "10.0.0.2", 80)
+		api2.Weight = testWeight(100)
+		for _, weight := range []uint8{100, 0} {
+			api1 := testServer("api1", "10.0.0.1", 80)
+			api1.Weight = testWeight(weight)
+			if err := common.handleReport([]ServiceReport{{Service: service, Reports: []Report{api1, api2}}}, router); err != nil {
+				t.Fatalf("Failed to apply report: %s", err)
+			}
+		}
+		received := []string{}
+		for len(commands) > 0 {
+			for _, command := range strings.Split(<-commands, "; ") {
+				if strings.Contains(command, "/api1 ") {
+					received = append(received, command)
+				}
+			}
+		}
+		if expected := "set weight api_" + strconv.Itoa(service.id) + "/api1 0"; strings.Join(received, ",") != expected {
+			t.Errorf("Expected socket command '%s', got '%s'", expected, strings.Join(received, ","))
+		}
+
+		if err := common.handleReport([]ServiceReport{{Service: service, Reports: []Report{api2}}}, router); err != nil {
+			t.Fatalf("Failed to apply report: %s", err)
+		}
+		if reloads := strings.Count(readTestFile(t, dir+"/reloads"), "\n"); reloads != 2 {
+			t.Errorf("Expected reloads for first report and removal only, got %d", reloads)
+		}
+		if config := readTestFile(t, dir+"/haproxy.cfg"); strings.Contains(config, "api1") {
+			t.Errorf("Expected removed server out of configuration:\n%s", config)
+		}
+	})
+}
+
+func TestStickyCookie(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  string
+		expected []string
+	}{
+		{
+			name:     "without cookie",
+			expected: []string{"server api1 10.0.0.1:80", "server api2 10.0.0.2:80"},
+		},
+		{
+			name:    "cookie of server name",
+			service: `"routerOptions":{"stickyCookie":"SRV"},`,
+			expected: []string{"cookie SRV insert indirect nocache",
+				"server api1 10.0.0.1:80 cookie api1", "server api2 10.0.0.2:80 cookie api2"},
+		},
+		{
+			name:    "cookie after backend options",
+			service: `"routerOptions":{"stickyCookie":"SRV","mode":"http","backend":["balance roundrobin"]},`,
+			expected: []string{"mode http", "balance roundrobin", "cookie SRV insert indirect nocache",
+				"server api1 10.0.0.1:80 cookie api1", "server api2 10.0.0.2:80 cookie api2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestHaProxy(t, dir, "", test.service)
+
+			report := ServiceReport{Reports: []Report{testServer("api1", "10.0.0.1", 80), testServer("api2", "10.0.0.2", 80)}}
+			if backend := testBackend(t, router, report); strings.Join(backend, "|") != strings.Join(test.expected, "|") {
+				t.Errorf("Expected backend:\n%s\ngot:\n%s", strings.Join(test.expected, "\n"), strings.Join(backend, "\n"))
+			}
+		})
+	}
+}
+
+func TestReportWeightReachesHaProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{name: "warming up", content: `{"name":"api1","host":"10.0.0.1","port":80,"available":true,"weight":30}`, expected: "server api1 10.0.0.1:80 weight 30"},
+		{name: "full weight", content: `{"name":"api1","host":"10.0.0.1","port":80,"available":true,"weight":255}`, expected: "server api1 10.0.0.1:80 weight 255"},
+		{name: "without weight", content: `{"name":"api1","host":"10.0.0.1","port":80,"available":true}`, expected: "server api1 10.0.0.1:80"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestHaProxy(t, dir, "", "")
+			service := router.getCommon().Services[0]
+
+			reports := newTestReportMap()
+			defer close(reports.changed)
+			reports.addRawReport("/services/api/1", []byte(test.content), nil, &zk.Stat{})
+			values, discoveryTime := reports.takeValues()
+			report := ServiceReport{Service: service, Reports: values, DiscoveryTime: discoveryTime}
+			if err := router.getCommon().handleReport([]ServiceReport{report}, router); err != nil {
+				t.Fatalf("Failed to apply report: %s", err)
+			}
+
+			config := readTestFile(t, dir+"/haproxy.cfg")
+			found := false
+			for _, line := range strings.Split(config, "\n") {
+				if strings.Join(strings.Fields(line), " ") == test.expected {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("Expected server line '%s' in configuration:\n%s", test.expected, config)
+			}
+		})
+	}
+}
+
+func TestWeightOnlyChangeBySocket(t *testing.T) {
+	tests := []struct {
+		name     string
+		weights  []uint8
+		commands []string
+		reloads  int
+	}{
+		{name: "weight change", weights: []uint8{100, 30}, commands: []string{"set weight api_ID/api1 30"}},
+		{name: "warmup steps", weights: []uint8{10, 50, 100}, commands: []string{"set weight api_ID/api1 50", "set weight api_ID/api1 100"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			listener, commands := testSocket(t, "unix", dir+"/haproxy.sock")
+			defer listener.Close()
+			router := newTestHaProxy(t, dir, `"socketAddress":"`+dir+`/haproxy.sock","reloadCommand":["sh","-c","echo >> `+dir+`/reloads"],`, "")
+			common := router.getCommon()
+			service := common.Services[0]
+
+			for _, weight := range test.weights {
+				server := testServer("api1", "10.0.0.1", 80)
+				server.Weight = testWeight(weight)
+				if err := common.handleReport([]ServiceReport{{Service: service, Reports: []Report{server}}}, router); err != nil {
+					t.Fatalf("Failed to apply report: %s", err)
+				}
+			}
+
+			if reloads := strings.Count(readTestFile(t, dir+"/reloads"), "\n"); reloads != 1 {
+				t.Errorf("Expected only the first report to reload, got %d reloads", reloads)
+			}
+			received := []string{}
+			for len(commands) > 0 {
+				received = append(received, <-commands)
+			}
+			expected := strings.Replace(strings.Join(test.commands, ","), "api_ID", "api_"+strconv.Itoa(service.id), -1)
+			if strings.Join(received, ",") != expected {
+				t.Errorf("Expected socket commands '%s', got '%s'", expected, strings.Join(received, ","))
+			}
+		})
+	}
+}
+
+func TestStaticDisabledServer(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	listener, commands := testSocket(t, "unix", dir+"/haproxy.sock")
+	defer listener.Close()
+	router := newTestHaProxy(t, dir, `"socketAddress":"`+dir+`/haproxy.sock",`,
+		`"routerOptions":{"backend":["server emergency 10.0.0.10:8080 disabled"]},`)
+	common := router.getCommon()
+	service := common.Services[0]
+
+	for _, weight := range []uint8{100, 30} {
+		server := testServer("api1", "10.0.0.1", 80)
+		server.Weight = testWeight(weight)
+		if err := common.handleReport([]ServiceReport{{Service: service, Reports: []Report{server}}}, router); err != nil {
+			t.Fatalf("Failed to apply report: %s", err)
+		}
+	}
+
+	if config := readTestFile(t, dir+"/haproxy.cfg"); !strings.Contains(config, "  server emergency 10.0.0.10:8080 disabled\n") {
+		t.Errorf("Expected static disabled server line verbatim in configuration:\n%s", config)
+	}
+	received := []string{}
+	for len(commands) > 0 {
+		received = append(received, <-commands)
+	}
+	expected := "set weight api_" + strconv.Itoa(service.id) + "/api1 30"
+	if strings.Join(received, ",") != expected {
+		t.Errorf("Expected socket commands '%s', got '%s'", expected, strings.Join(received, ","))
+	}
+}
+
+func TestServiceActionsOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		router  string
+		web     string
+		apply   func(t *testing.T, router *RouterHaProxy)
+		written bool
+		reloads int
+	}{
+		{
+			name: "write only service change",
+			web:  `"routerOptions":{"doReloads":false},`,
+			apply: func(t *testing.T, router *RouterHaProxy) {
+				applyTestHaProxy(t, router, 1)
+			},
+			written: true,
+		},
+		{
+			name: "reloading service change",
+			web:  `"routerOptions":{"doReloads":false},`,
+			apply: func(t *testing.T, router *RouterHaProxy) {
+				applyTestHaProxy(t, router, 0)
+			},
+			written: true,
+			reloads: 1,
+		},
+		{
+			name: "service without writes and reloads",
+			web:  `"routerOptions":{"doReloads":false,"doWrites":false},`,
+			apply: func(t *testing.T, router *RouterHaProxy) {
+				applyTestHaProxy(t, router, 1)
+			},
+		},
+		{
+			name:   "service reloading when router does not",
+			router: `"doReloads":false,`,
+			web:    `"routerOptions":{"doReloads":true},`,
+			apply: func(t *testing.T, router *RouterHaProxy) {
+				applyTestHaProxy(t, router, 1)
+			},
+			written: true,
+			reloads: 1,
+		},
+		{
+			name: "removal of write only service",
+			web:  `"routerOptions":{"doReloads":false},`,
+			apply: func(t *testing.T, router *RouterHaProxy) {
+				if err := router.removeService(router.getCommon().Services[1]); err != nil {
+					t.Fatalf("Failed to remove service: %s", err)
+				}
+			},
+			written: true,
+		},
+		{
+			name: "removal of service without writes and reloads",
+			web:  `"routerOptions":{"doReloads":false,"doWrites":false},`,
+			apply: func(t *testing.T, router *RouterHaProxy) {
+				if err := router.removeService(router.getCommon().Services[1]); err != nil {
+					t.Fatalf("Failed to remove service: %s", err)
+				}
+			},
+		},
+		{
+			name:   "forced reload allowed by a service",
+			router: `"doReloads":false,`,
+			web:    `"routerOptions":{"doReloads":true},`,
+			apply: func(t *testing.T, router *RouterHaProxy) {
+				if _, err := router.forceReload(); err != nil {
+					t.Fatalf("Failed to force reload: %s", err)
+				}
+			},
+			written: true,
+			reloads: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestRouter(t, newTestSynapse(), `{"type":"haproxy","configPath":"`+dir+`/haproxy.cfg",
+				"reloadCommand":["sh","-c","echo >> `+dir+`/reloads"],"reloadMinIntervalInMilli":1,`+test.router+`
+				"services":[{"name":"api","watcher":`+testWatcher+`},{"name":"web",`+test.web+`"watcher":`+testWatcher+`}]}`).(*RouterHaProxy)
+
+			test.apply(t, router)
+
+			if written := readTestFile(t, dir+"/haproxy.cfg") != ""; written != test.written {
+				t.Errorf("Expected configuration written %t, got %t", test.written, written)
+			}
+			if reloads := strings.Count(readTestFile(t, dir+"/reloads"), "\n"); reloads != test.reloads {
+				t.Errorf("Expected %d reloads, got %d", test.reloads, reloads)
+			}
+		})
+	}
+}
+
+// apply a report with one server to the service at index
+func applyTestHaProxy(t *testing.T, router *RouterHaProxy, index int) {
+	report := ServiceReport{Service: router.getCommon().Services[index], Reports: []Report{testServer("server1", "10.0.0.1", 80)}}
+	if err := router.getCommon().handleReport([]ServiceReport{report}, router); err != nil {
+		t.Fatalf("Failed to apply report: %s", err)
+	}
+}
+
+func TestTlsBind(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	certificate := dir + "/api.pem"
+	if err := ioutil.WriteFile(certificate, []byte{}, 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %s", err)
+	}
+	tls := func(bind string) string {
+		return `"routerOptions":{"mode":"http","tls":{"bind":"` + bind + `","certificates":["` + certificate + `"],"alpn":["h2","http/1.1"],"redirectHttps":true}},`
+	}
+	service := func(name string, options string) string {
+		return `{"name":"` + name + `",` + options + `"watcher":` + testWatcher + `}`
+	}
+
+	tests := []struct {
+		name     string
+		services []string
+		valid    bool
+	}{
+		{name: "single service default bind", services: []string{service("api", tls(""))}, valid: true},
+		{name: "tls and plain services", services: []string{service("api", tls("")), service("web", "")}, valid: true},
+		{name: "several services with own binds", services: []string{service("api", tls(":443")), service("web", tls(":8443"))}, valid: true},
+		{name: "several services with default bind", services: []string{service("api", tls("")), service("web", tls(":8443"))}},
+		{name: "several services with same bind", services: []string{service("api", tls(":443")), service("web", tls(":443"))}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := `{"type":"haproxy","configPath":"` + dir + `/haproxy.cfg","reloadCommand":["true"],
+				"services":[` + strings.Join(test.services, ",") + `]}`
+			problems := validateRouter([]byte(config), "", nil)
+			if (len(problems) == 0) != test.valid {
+				t.Fatalf("Expected valid %t, got %v", test.valid, problems)
+			}
+			if !test.valid {
+				return
+			}
+
+			router := newTestRouter(t, newTestSynapse(), config).(*RouterHaProxy)
+			report := ServiceReport{Service: router.getCommon().Services[0], Reports: []Report{testServer("api1", "10.0.0.1", 80)}}
+			frontend, _, err := router.toFrontendAndBackend(report)
+			if err != nil {
+				t.Fatalf("Failed to render frontend: %s", err)
+			}
+			expected := []string{"mode http", "bind :443 ssl crt " + certificate + " alpn h2,http/1.1",
+				"http-request redirect scheme https unless { ssl_fc }", "default_backend api_" + strconv.Itoa(report.Service.id)}
+			if strings.Join(frontend, "|") != strings.Join(expected, "|") {
+				t.Errorf("Expected frontend:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(frontend, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package synapse
+
+import (
+	"encoding/json"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RouterIpvs struct {
+	RouterCommon
+	IpvsadmCommand      []string
+	TimeoutInMilli      int
+	DrainTimeoutInMilli int
+
+	virtuals     map[*Service]struct{}
+	destinations map[*Service]map[string]int
+	draining     map[*Service]map[string]*time.Timer // removal scheduled at the end of drain
+}
+
+type IpvsRouterOptions struct {
+	VirtualService string
+	Protocol       string
+	Scheduler      string
+	Forwarding     string
+}
+
+func NewRouterIpvs() *RouterIpvs {
+	return &RouterIpvs{
+		virtuals:     make(map[*Service]struct{}),
+		destinations: make(map[*Service]map[string]int),
+		draining:     make(map[*Service]map[string]*time.Timer),
+	}
+}
+
+func (r *RouterIpvs) Run(context *ContextImpl) {
+	r.RunCommon(context, r)
+}
+
+func (r *RouterIpvs) Init(s *Synapse) error {
+	if err := r.commonInit(r, s); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to init common router")
+	}
+
+	r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Set(0)
+
+	if len(r.IpvsadmCommand) == 0 {
+		r.IpvsadmCommand = []string{"ipvsadm"}
+	}
+	if r.TimeoutInMilli == 0 {
+		r.TimeoutInMilli = 1000
+	}
+	return nil
+}
+
+func (r *RouterIpvs) validate(fields data.Fields) []error {
+	problems := []error{}
+	for i, service := range r.Services {
+		if len(service.RouterOptions) == 0 {
+			problems = append(problems, errs.WithF(fields.WithField("service", i), "routerOptions with virtualService is required for ipvs router"))
+		}
+	}
+	return problems
+}
+
+func (r *RouterIpvs) Update(serviceReports []ServiceReport) error {
+	for _, report := range serviceReports {
+		if err := r.updateService(report); err != nil {
+			return errs.WithEF(err, report.Service.fields, "Failed to update ipvs virtual service")
+		}
+		r.synapse.routerServerCount.WithLabelValues(r.Type, report.Service.Name).Set(float64(len(report.Reports)))
+	}
+	return nil
+}
+
+func (r *RouterIpvs) updateService(report ServiceReport) error {
+	options := report.Service.typedRouterOptions.(IpvsRouterOptions)
+	virtual := []string{options.Protocol, options.VirtualService}
+
+	if _, ok := r.virtuals[report.Service]; !ok {
+		if err := r.ipvsadm(append([]string{"-A"}, append(virtual, "-s", options.Scheduler)...)...); err != nil {
+			logs.WithEF(err, report.Service.fields).Debug("Cannot add virtual service, trying to edit it")
+			if err := r.ipvsadm(append([]string{"-E"}, append(virtual, "-s", options.Scheduler)...)...); err != nil {
+				return errs.WithEF(err, report.Service.fields, "Failed to declare virtual service")
+			}
+		}
+		// destinations left by a previous run are updated in place, and removed if not reported anymore
+		existing, err := r.listDestinations(virtual)
+		if err != nil {
+			return errs.WithEF(err, report.Service.fields, "Failed to list real servers of virtual service")
+		}
+		r.virtuals[report.Service] = struct{}{}
+		r.destinations[report.Service] = existing
+		r.draining[report.Service] = make(map[string]*time.Timer)
+	}
+	current := r.destinations[report.Service]
+	draining := r.draining[report.Service]
+
+	wanted := make(map[string]int)
+	for _, server := range report.Reports {
+		weight := 1
+		if server.Weight != nil {
+			weight = int(*server.Weight)
+		}
+		if server.Available != nil && !*server.Available {
+			weight = 0 // keep established connections
+		}
+		wanted[server.address()] = weight
+	}
+
+	for address, weight := range wanted {
+		previous, ok := current[address]
+		if ok && previous == weight {
+			continue
+		}
+		action := "-a"
+		if ok {
+			action = "-e"
+		}
+		if err := r.ipvsadm(append([]string{action}, append(virtual, "-r", address, options.Forwarding, "-w", strconv.Itoa(weight))...)...); err != nil {
+			return errs.WithEF(err, report.Service.fields.WithField("server", address), "Failed to set real server")
+		}
+		current[address] = weight
+		if timer, ok := draining[address]; ok {
+			timer.Stop()
+			delete(draining, address)
+		}
+	}
+
+	// removed servers get weight 0 first and are deleted when the drain timeout expires
+	for address := range current {
+		if _, ok := wanted[address]; ok {
+			continue
+		}
+		if _, ok := draining[address]; ok {
+			continue
+		}
+		if r.DrainTimeoutInMilli <= 0 {
+			if err := r.removeDestination(report.Service, address); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.ipvsadm(append([]string{"-e"}, append(virtual, "-r", address, options.Forwarding, "-w", "0")...)...); err != nil {
+			return errs.WithEF(err, report.Service.fields.WithField("server", address), "Failed to drain real server")
+		}
+		current[address] = 0
+		draining[address] = r.scheduleRemoval(report.Service, address)
+	}
+	return nil
+}
+
+func (r *RouterIpvs) scheduleRemoval(service *Service, address string) *time.Timer {
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(r.DrainTimeoutInMilli)*time.Millisecond, func() {
+		r.handleMutex.Lock()
+		defer r.handleMutex.Unlock()
+		// server came back, or service removed, meanwhile
+		if r.draining[service][address] != timer {
+			return
+		}
+		if err := r.removeDestination(service, address); err != nil {
+			r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Inc()
+			logs.WithEF(err, r.fields).Error("Failed to remove drained real server")
+		}
+	})
+	return timer
+}
+
+func (r *RouterIpvs) removeDestination(service *Service, address string) error {
+	options := service.typedRouterOptions.(IpvsRouterOptions)
+	if err := r.ipvsadm("-d", options.Protocol, options.VirtualService, "-r", address); err != nil {
+		return errs.WithEF(err, service.fields.WithField("server", address), "Failed to remove real server")
+	}
+	delete(r.destinations[service], address)
+	delete(r.draining[service], address)
+	return nil
+}
+
+// real servers of a virtual service with their weight. Empty if the virtual service is new
+func (r *RouterIpvs) listDestinations(virtual []string) (map[string]int, error) {
+	command := append(append([]string{}, r.IpvsadmCommand...), append([]string{"-L", "-n"}, virtual...)...)
+	output, err := execCommandOutput(command, os.Environ(), r.TimeoutInMilli)
+	if err != nil {
+		return nil, err
+	}
+	destinations := make(map[string]int)
+	for _, line := range strings.Split(string(output), "\n") {
+		// '  -> 10.0.0.1:80    Route   1      0          0'
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "->" || fields[1] == "RemoteAddress:Port" {
+			continue
+		}
+		weight, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, errs.WithEF(err, r.fields.WithField("line", line), "Failed to read real server weight")
+		}
+		destinations[fields[1]] = weight
+	}
+	return destinations, nil
+}
+
+func (r *RouterIpvs) removeService(service *Service) error {
+	if _, ok := r.virtuals[service]; !ok {
+		return nil
+	}
+	options := service.typedRouterOptions.(IpvsRouterOptions)
+	for _, timer := range r.draining[service] {
+		timer.Stop()
+	}
+	delete(r.virtuals, service)
+	delete(r.destinations, service)
+	delete(r.draining, service)
+	if err := r.ipvsadm("-D", options.Protocol, options.VirtualService); err != nil {
+		return errs.WithEF(err, service.fields, "Failed to remove virtual service")
+	}
+	return nil
+}
+
+func (r *RouterIpvs) ipvsadm(args ...string) error {
+	command := append(append([]string{}, r.IpvsadmCommand...), args...)
+	logs.WithF(r.fields.WithField("command", command)).Debug("Running ipvsadm")
+	return execCommand(command, os.Environ(), r.TimeoutInMilli)
+}
+
+func (r *RouterIpvs) ParseServerOptions(data []byte) (interface{}, error) {
+	return nil, nil
+}
+
+func (r *RouterIpvs) ParseRouterOptions(data []byte) (interface{}, error) {
+	routerOptions := IpvsRouterOptions{}
+	fields := r.fields.WithField("content", string(data))
+	if err := json.Unmarshal(data, &routerOptions); err != nil {
+		return nil, errs.WithEF(err, fields, "Failed to Unmarshal routerOptions")
+	}
+
+	if routerOptions.VirtualService == "" {
+		return nil, errs.WithF(fields, "virtualService is required for ipvs router")
+	}
+	switch routerOptions.Protocol {
+	case "", "tcp":
+		routerOptions.Protocol = "-t"
+	case "udp":
+		routerOptions.Protocol = "-u"
+	default:
+		return nil, errs.WithF(fields.WithField("protocol", routerOptions.Protocol), "Unsupported ipvs protocol")
+	}
+	switch routerOptions.Forwarding {
+	case "", "route":
+		routerOptions.Forwarding = "-g"
+	case "nat":
+		routerOptions.Forwarding = "-m"
+	case "tunnel":
+		routerOptions.Forwarding = "-i"
+	default:
+		return nil, errs.WithF(fields.WithField("forwarding", routerOptions.Forwarding), "Unsupported ipvs forwarding method")
+	}
+	if routerOptions.Scheduler == "" {
+		routerOptions.Scheduler = "wrr"
+	}
+	return routerOptions, nil
+}
@@ -0,0 +1,133 @@
+package synapse
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testIpvsList = `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port           Forward Weight ActiveConn InActConn
+TCP  10.0.0.100:80 wrr
+  -> 10.0.0.1:80                  Route   1      0          0
+  -> 10.0.0.9:80                  Route   1      3          0
+`
+
+// ipvs router running a fake ipvsadm, that records its calls and lists existing destinations
+func newTestIpvs(t *testing.T, dir string, existing string, drainTimeoutInMilli string) *RouterIpvs {
+	script := "echo \"$@\" >> " + dir + "/calls\n[ \"$1\" = -L ] && cat " + dir + "/list\nexit 0\n"
+	if err := ioutil.WriteFile(dir+"/ipvsadm", []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write fake ipvsadm: %s", err)
+	}
+	if err := ioutil.WriteFile(dir+"/list", []byte(existing), 0644); err != nil {
+		t.Fatalf("Failed to write ipvs list: %s", err)
+	}
+	return newTestRouter(t, newTestSynapse(), `{"type":"ipvs","ipvsadmCommand":["sh","`+dir+`/ipvsadm"],
+		"drainTimeoutInMilli":`+drainTimeoutInMilli+`,
+		"services":[{"name":"api","routerOptions":{"virtualService":"10.0.0.100:80"},"watcher":`+testWatcher+`}]}`).(*RouterIpvs)
+}
+
+func applyTestIpvs(t *testing.T, router *RouterIpvs, servers ...Report) {
+	common := router.getCommon()
+	common.handleMutex.Lock()
+	defer common.handleMutex.Unlock()
+	if err := common.handleReport([]ServiceReport{{Service: common.Services[0], Reports: servers}}, router); err != nil {
+		t.Fatalf("Failed to apply report: %s", err)
+	}
+}
+
+// ipvsadm calls after the listing, if any
+func testIpvsCalls(t *testing.T, dir string) []string {
+	calls := []string{}
+	for _, call := range strings.Split(strings.TrimSpace(readTestFile(t, dir+"/calls")), "\n") {
+		if call != "" && !strings.HasPrefix(call, "-L") && !strings.HasPrefix(call, "-A") {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func TestIpvsExistingDestinations(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		expected []string
+	}{
+		{
+			name:     "new virtual service",
+			expected: []string{"-a -t 10.0.0.100:80 -r 10.0.0.1:80 -g -w 1"},
+		},
+		{
+			name:     "restart with existing destinations",
+			existing: testIpvsList,
+			expected: []string{"-d -t 10.0.0.100:80 -r 10.0.0.9:80"},
+		},
+		{
+			name:     "restart with other weight",
+			existing: strings.Replace(testIpvsList, "Route   1      0", "Route   5      0", 1),
+			expected: []string{"-e -t 10.0.0.100:80 -r 10.0.0.1:80 -g -w 1", "-d -t 10.0.0.100:80 -r 10.0.0.9:80"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestIpvs(t, dir, test.existing, "0")
+
+			applyTestIpvs(t, router, testServer("api1", "10.0.0.1", 80))
+
+			if calls := testIpvsCalls(t, dir); strings.Join(calls, "|") != strings.Join(test.expected, "|") {
+				t.Errorf("Expected ipvsadm calls:\n%s\ngot:\n%s", strings.Join(test.expected, "\n"), strings.Join(calls, "\n"))
+			}
+		})
+	}
+}
+
+func TestIpvsDrainRemovesAfterTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		back     bool
+		expected []string
+	}{
+		{
+			name: "removed at drain timeout",
+			expected: []string{"-a -t 10.0.0.100:80 -r 10.0.0.1:80 -g -w 1", "-a -t 10.0.0.100:80 -r 10.0.0.2:80 -g -w 1",
+				"-e -t 10.0.0.100:80 -r 10.0.0.2:80 -g -w 0", "-d -t 10.0.0.100:80 -r 10.0.0.2:80"},
+		},
+		{
+			name: "back before drain timeout",
+			back: true,
+			expected: []string{"-a -t 10.0.0.100:80 -r 10.0.0.1:80 -g -w 1", "-a -t 10.0.0.100:80 -r 10.0.0.2:80 -g -w 1",
+				"-e -t 10.0.0.100:80 -r 10.0.0.2:80 -g -w 0", "-e -t 10.0.0.100:80 -r 10.0.0.2:80 -g -w 1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			router := newTestIpvs(t, dir, "", "100")
+			api1 := testServer("api1", "10.0.0.1", 80)
+			api2 := testServer("api2", "10.0.0.2", 80)
+
+			applyTestIpvs(t, router, api1, api2)
+			applyTestIpvs(t, router, api1)
+			if test.back {
+				applyTestIpvs(t, router, api1, api2)
+			}
+			time.Sleep(300 * time.Millisecond) // no report meanwhile
+
+			calls := testIpvsCalls(t, dir)
+			if len(calls) >= 2 && calls[0] > calls[1] {
+				calls[0], calls[1] = calls[1], calls[0] // destinations of a report are added in any order
+			}
+			if strings.Join(calls, "|") != strings.Join(test.expected, "|") {
+				t.Errorf("Expected ipvsadm calls:\n%s\ngot:\n%s", strings.Join(test.expected, "\n"), strings.Join(calls, "\n"))
+			}
+		})
+	}
+}
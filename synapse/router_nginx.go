@@ -0,0 +1,175 @@
+package synapse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"os"
+	"strconv"
+	"text/template"
+)
+
+const nginxConfigurationTemplate = `# Handled by synapse. Do not modify it.
+{{range $key, $element := .}}
+upstream {{$key}} {
+{{- range $element}}
+  {{.}}{{end}}
+}
+{{end}}
+`
+
+type RouterNginx struct {
+	RouterCommon
+	ConfigPath           string
+	ConfigFileMode       FileMode
+	ReloadCommand        []string
+	ReloadTimeoutInMilli int
+
+	upstreams  map[string][]string
+	lastConfig []byte
+	template   *template.Template
+}
+
+type NginxRouterOptions struct {
+	Upstream []string
+}
+
+func NewRouterNginx() *RouterNginx {
+	return &RouterNginx{
+		upstreams: make(map[string][]string),
+	}
+}
+
+func (r *RouterNginx) Run(context *ContextImpl) {
+	r.RunCommon(context, r)
+}
+
+func (r *RouterNginx) Init(s *Synapse) error {
+	if err := r.commonInit(r, s); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to init common router")
+	}
+
+	r.synapse.routerUpdateFailures.WithLabelValues(r.Type).Set(0)
+
+	r.fields = r.fields.WithField("config", r.ConfigPath)
+	if r.ConfigFileMode == 0 {
+		r.ConfigFileMode = 0644
+	}
+	if len(r.ReloadCommand) == 0 {
+		r.ReloadCommand = []string{"nginx", "-s", "reload"}
+	}
+	if r.ReloadTimeoutInMilli == 0 {
+		r.ReloadTimeoutInMilli = 1000
+	}
+
+	tmpl, err := template.New("nginx-config").Parse(nginxConfigurationTemplate)
+	if err != nil {
+		return errs.WithEF(err, r.fields, "Failed to parse nginx config template")
+	}
+	r.template = tmpl
+	return nil
+}
+
+func (r *RouterNginx) validate(fields data.Fields) []error {
+	if r.ConfigPath == "" {
+		return []error{errs.WithF(fields, "ConfigPath is required for nginx router")}
+	}
+	return nil
+}
+
+func (r *RouterNginx) Update(serviceReports []ServiceReport) error {
+	for _, report := range serviceReports {
+		r.upstreams[report.Service.Name+"_"+strconv.Itoa(report.Service.id)] = r.toUpstream(report)
+	}
+
+	var b bytes.Buffer
+	writer := bufio.NewWriter(&b)
+	if err := r.template.Execute(writer, r.upstreams); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to template nginx configuration file")
+	}
+	if err := writer.Flush(); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to flush buffer")
+	}
+
+	templated := b.Bytes()
+	if bytes.Equal(templated, r.lastConfig) {
+		logs.WithF(r.fields).Debug("Nginx configuration not modified. No reload")
+		return nil
+	}
+
+	if err := writeFileAtomic(r.ConfigPath, templated, os.FileMode(r.ConfigFileMode)); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to write nginx configuration")
+	}
+
+	logs.WithF(r.fields).Debug("Reloading nginx")
+	if err := execCommand(r.ReloadCommand, os.Environ(), r.ReloadTimeoutInMilli); err != nil {
+		return errs.WithEF(err, r.fields, "Failed to reload nginx")
+	}
+	r.lastConfig = templated
+	return nil
+}
+
+func (r *RouterNginx) removeService(service *Service) error {
+	delete(r.upstreams, service.Name+"_"+strconv.Itoa(service.id))
+	return r.Update([]ServiceReport{})
+}
+
+func (r *RouterNginx) toUpstream(report ServiceReport) []string {
+	upstream := []string{}
+	if report.Service.typedRouterOptions != nil {
+		for _, option := range report.Service.typedRouterOptions.(NginxRouterOptions).Upstream {
+			upstream = append(upstream, option)
+		}
+	}
+
+	serverOptions := ""
+	if report.Service.typedServerOptions != nil {
+		serverOptions = report.Service.typedServerOptions.(string)
+	}
+	for _, server := range report.Reports {
+		var buffer bytes.Buffer
+		buffer.WriteString("server ")
+		if server.isUnixSocket() {
+			buffer.WriteString("unix:")
+			buffer.WriteString(server.SocketPath)
+		} else {
+			buffer.WriteString(server.address())
+		}
+		if (server.Available != nil && !*server.Available) || (server.Weight != nil && *server.Weight == 0) {
+			buffer.WriteString(" down")
+		} else if server.Weight != nil {
+			buffer.WriteString(" weight=")
+			buffer.WriteString(strconv.Itoa(int(*server.Weight)))
+		}
+		if serverOptions != "" {
+			buffer.WriteString(" ")
+			buffer.WriteString(serverOptions)
+		}
+		buffer.WriteString(";")
+		upstream = append(upstream, buffer.String())
+	}
+	return upstream
+}
+
+func (r *RouterNginx) ParseServerOptions(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var serverOptions string
+	if err := json.Unmarshal(data, &serverOptions); err != nil {
+		return nil, errs.WithEF(err, r.fields.WithField("content", string(data)), "Failed to Unmarshal serverOptions")
+	}
+	return serverOptions, nil
+}
+
+func (r *RouterNginx) ParseRouterOptions(data []byte) (interface{}, error) {
+	routerOptions := NginxRouterOptions{}
+	if err := json.Unmarshal(data, &routerOptions); err != nil {
+		return nil, errs.WithEF(err, r.fields.WithField("content", string(data)), "Failed to Unmarshal routerOptions")
+	}
+	return routerOptions, nil
+}
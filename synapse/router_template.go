@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"github.com/blablacar/dgr/bin-templater/template"
-	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
 	"io/ioutil"
 	"os"
@@ -36,19 +36,10 @@ func (r *RouterTemplate) Init(s *Synapse) error {
 		return errs.WithEF(err, r.fields, "Failed to init common router")
 	}
 
-	if r.DestinationFile == "" {
-		return errs.WithF(r.fields, "DestinationFile is mandatory")
-	}
 	r.fields = r.fields.WithField("file", r.DestinationFile)
 	if r.DestinationFileMode == 0 {
 		r.DestinationFileMode = 0644
 	}
-	if r.Template == "" && r.TemplateFile == "" {
-		return errs.WithF(r.fields, "Template or TemplateFile are mandatory")
-	}
-	if r.Template != "" && r.TemplateFile != "" {
-		return errs.WithF(r.fields, "use Template or TemplateFile")
-	}
 	if r.PostTemplateCommandTimeoutInMilli == 0 {
 		r.PostTemplateCommandTimeoutInMilli = 2000
 	}
@@ -69,10 +60,21 @@ func (r *RouterTemplate) Init(s *Synapse) error {
 	return nil
 }
 
+func (r *RouterTemplate) validate(fields data.Fields) []error {
+	problems := []error{}
+	if r.DestinationFile == "" {
+		problems = append(problems, errs.WithF(fields, "DestinationFile is mandatory"))
+	}
+	if (r.Template == "") == (r.TemplateFile == "") {
+		problems = append(problems, errs.WithF(fields, "One of Template or TemplateFile is mandatory"))
+	}
+	return problems
+}
+
 func (r *RouterTemplate) Update(reports []ServiceReport) error {
 	buff := bytes.Buffer{}
 	writer := bufio.NewWriter(&buff)
-	if err := r.tmpl.Execute(writer, reports); err != nil {
+	if err := r.tmpl.Execute(writer, r.currentReports(reports)); err != nil {
 		return errs.WithEF(err, r.fields, "Templating execution failed")
 	}
 
@@ -90,7 +92,7 @@ func (r *RouterTemplate) Update(reports []ServiceReport) error {
 	}
 
 	if len(r.PostTemplateCommand) > 0 {
-		if err := nerve.ExecCommand(r.PostTemplateCommand, r.PostTemplateCommandTimeoutInMilli); err != nil {
+		if err := execCommand(r.PostTemplateCommand, os.Environ(), r.PostTemplateCommandTimeoutInMilli); err != nil {
 			return errs.WithEF(err, r.fields, "Post template command failed")
 		}
 	}
@@ -98,6 +100,28 @@ func (r *RouterTemplate) Update(reports []ServiceReport) error {
 	return nil
 }
 
+// last report of each service, in services order, with the given ones replacing previous
+func (r *RouterTemplate) currentReports(reports []ServiceReport) []ServiceReport {
+	updated := make(map[*Service]ServiceReport)
+	for _, report := range reports {
+		updated[report.Service] = report
+	}
+
+	current := []ServiceReport{}
+	for _, service := range r.Services {
+		if report, ok := updated[service]; ok {
+			current = append(current, report)
+		} else if last, ok := r.lastEvents[service]; ok {
+			current = append(current, *last)
+		}
+	}
+	return current
+}
+
+func (r *RouterTemplate) removeService(service *Service) error {
+	return r.Update([]ServiceReport{})
+}
+
 func (r *RouterTemplate) ParseServerOptions(data []byte) (interface{}, error) {
 	return nil, nil
 }
@@ -0,0 +1,48 @@
+package synapse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplatePostCommand(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	os.Setenv("SYNAPSE_TEST_TEMPLATE", "from synapse")
+	defer os.Unsetenv("SYNAPSE_TEST_TEMPLATE")
+
+	tests := []struct {
+		name    string
+		command string
+		err     bool
+	}{
+		{name: "synapse environment", command: `"sh","-c","echo $SYNAPSE_TEST_TEMPLATE > ` + filepath.Join(dir, "env") + `"`},
+		{name: "grandchild killed on timeout", command: `"sh","-c","sleep 10 & sleep 10"`, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newTestRouter(t, newTestSynapse(), `{"type":"template","destinationFile":"`+filepath.Join(dir, "servers")+`",
+				"template":"servers","postTemplateCommand":[`+test.command+`],"postTemplateCommandTimeoutInMilli":200,
+				"services":[{"watcher":`+testWatcher+`}]}`)
+
+			start := time.Now()
+			err := router.Update([]ServiceReport{})
+			if (err != nil) != test.err {
+				t.Fatalf("Expected error %t, got %v", test.err, err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Expected command to end with its timeout, took %s", elapsed)
+			}
+		})
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "env"))
+	if err != nil || strings.TrimSpace(string(content)) != "from synapse" {
+		t.Errorf("Expected command to get synapse environment, got %q, %v", content, err)
+	}
+}
@@ -0,0 +1,108 @@
+package synapse
+
+import (
+	"bytes"
+	dto "github.com/prometheus/client_model/go"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRejectedReportIsFullyAppliedAgain(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	router := newTestRouter(t, newTestSynapse(), `{"type":"haproxy","configPath":"`+dir+`/haproxy.cfg",
+		"reloadCommand":["true"],"reloadMinIntervalInMilli":1,"socketAddress":"`+dir+`/haproxy.sock",
+		"checkConfig":true,"checkCommand":["sh","-c","! grep -q invalid \"$0\""],
+		"services":[{"name":"api","watcher":`+testWatcher+`}]}`).(*RouterHaProxy)
+	common := router.getCommon()
+	service := common.Services[0]
+
+	good := ServiceReport{Service: service, Reports: []Report{testServer("api1", "10.0.0.1", 80)}}
+	bad := ServiceReport{Service: service, Reports: []Report{testServer("api1", "10.0.0.1", 80)}}
+	bad.Reports[0].HaProxyServerOptions = "invalid"
+
+	common.handleReport([]ServiceReport{good}, router)
+	for i := 0; i < 2; i++ {
+		common.handleReport([]ServiceReport{bad}, router)
+		if config := readTestFile(t, dir+"/haproxy.cfg"); strings.Contains(config, "invalid") {
+			t.Fatalf("Configuration failing check was written after %d bad reports:\n%s", i+1, config)
+		}
+		if options := common.lastEvents[service].Reports[0].HaProxyServerOptions; options != "" {
+			t.Fatalf("Rejected report was kept as applied, with options '%s'", options)
+		}
+	}
+}
+
+func TestFirstRoundDoneOnceAllServicesReported(t *testing.T) {
+	s := newTestSynapse()
+	router := newTestRouter(t, s, `{"type":"console","services":[
+		{"name":"api","watcher":`+testWatcher+`},{"name":"web","watcher":`+testWatcher+`}]}`)
+	s.typedRouters = []Router{router}
+	common := router.getCommon()
+	done := s.FirstRoundDone()
+
+	common.handleReport([]ServiceReport{{Service: common.Services[0]}}, router)
+	select {
+	case <-done:
+		t.Fatalf("First round done before all services reported")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	common.handleReport([]ServiceReport{{Service: common.Services[1], Reports: []Report{testServer("web1", "10.0.0.1", 80)}}}, router)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("First round not done after all services reported")
+	}
+	common.handleReport([]ServiceReport{{Service: common.Services[0]}}, router)
+}
+
+func TestBackendServersGaugeAfterMinAvailableRatio(t *testing.T) {
+	s := newTestSynapse()
+	router := newTestRouter(t, s, `{"type":"console","services":[{"name":"api","minAvailableRatio":0.5,"watcher":`+testWatcher+`}]}`)
+	common := router.getCommon()
+
+	reports := []Report{testServer("api1", "10.0.0.1", 80), testServer("api2", "10.0.0.2", 80), testServer("api3", "10.0.0.3", 80)}
+	reports[1].Available = testBool(false)
+	reports[2].Available = testBool(false)
+	common.handleReport([]ServiceReport{{Service: common.Services[0], Reports: reports}}, router)
+
+	expected := map[string]float64{SERVER_STATE_AVAILABLE: 0, SERVER_STATE_UNAVAILABLE: 0, SERVER_STATE_DISABLED: 3, SERVER_STATE_BACKUP: 0}
+	for state, count := range expected {
+		metric := dto.Metric{}
+		if err := s.backendServers.WithLabelValues("api", state).Write(&metric); err != nil {
+			t.Fatalf("Failed to read gauge: %s", err)
+		}
+		if value := metric.GetGauge().GetValue(); value != count {
+			t.Errorf("Expected %v %s servers, got %v", count, state, value)
+		}
+	}
+}
+
+func TestNoBufferedUpdateAfterStop(t *testing.T) {
+	router := newTestRouter(t, newTestSynapse(), `{"type":"console","eventsBufferDurationInMilli":200,
+		"services":[{"name":"api","watcher":`+testWatcher+`}]}`).(*RouterConsole)
+	output := &bytes.Buffer{}
+	router.writer = output
+	common := router.getCommon()
+
+	context := newContext(false)
+	go router.Run(context)
+	var events chan ServiceReport
+	for events == nil {
+		time.Sleep(10 * time.Millisecond)
+		common.handleMutex.Lock()
+		events = common.events
+		common.handleMutex.Unlock()
+	}
+
+	events <- ServiceReport{Service: common.Services[0], Reports: []Report{testServer("api1", "10.0.0.1", 80)}}
+	close(context.stop)
+	context.doneWaiter.Wait()
+	time.Sleep(400 * time.Millisecond)
+	if output.Len() > 0 {
+		t.Errorf("Expected no router update after stop, got %s", output.String())
+	}
+}
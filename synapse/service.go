@@ -6,12 +6,16 @@ import (
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
+	"strings"
 	"sync"
+	"time"
 )
 
 type ServiceReport struct {
-	Service *Service
-	Reports []Report
+	Service       *Service
+	Reports       []Report
+	DiscoveryTime time.Time
+	Disabled      bool // all servers out of rotation, because of minAvailableRatio
 }
 
 func (s *ServiceReport) String() string {
@@ -27,6 +31,20 @@ func (s *ServiceReport) HasActiveServers() bool {
 	return false
 }
 
+// set all servers unavailable
+func (s *ServiceReport) disableAll() {
+	reports := make([]Report, len(s.Reports))
+	copy(reports, s.Reports)
+	for i := range reports {
+		available := false
+		weight := uint8(0)
+		reports[i].Available = &available
+		reports[i].Weight = &weight
+	}
+	s.Reports = reports
+	s.Disabled = true
+}
+
 func (s *ServiceReport) AvailableUnavailable() (int, int) {
 	var available, unavailable int
 	for _, report := range s.Reports {
@@ -48,8 +66,16 @@ type Service struct {
 	RouterOptions json.RawMessage
 	ServerOptions json.RawMessage
 	ServerSort    ReportSortType
+	// with label sort, servers are grouped by this label value, groups in this order
+	ServerSortLabel      string
+	ServerSortLabelOrder []string
+	MinimumHosts         int
+	// disable all servers when less than this ratio of them are available, so routers can fail over
+	MinAvailableRatio float64
 
 	id                 int
+	disabledServers    map[string]struct{}
+	config             []byte
 	synapse            *Synapse
 	fields             data.Fields
 	typedWatcher       Watcher
@@ -58,22 +84,29 @@ type Service struct {
 }
 
 func (s *Service) Init(router Router, synapse *Synapse) error {
+	config, err := json.Marshal(s)
+	if err != nil {
+		return errs.WithE(err, "Failed to marshal service configuration")
+	}
+	s.config = config
+
 	idCountMutex.Lock()
 	s.id = idCount
 	idCount++
 	idCountMutex.Unlock()
 
 	s.synapse = synapse
+	s.disabledServers = make(map[string]struct{})
 	s.fields = router.getFields().WithField("service", s.Name)
+	if problems := s.validate(s.fields, synapse.Zone); len(problems) > 0 {
+		return errs.WithF(s.fields, "Invalid service configuration").WithErrs(problems...)
+	}
 	watcher, err := WatcherFromJson(s.Watcher, s)
 	if err != nil {
 		return errs.WithEF(err, s.fields, "Failed to read watcher")
 	}
 	logs.WithF(watcher.GetFields()).Debug("Watcher loaded")
 	s.typedWatcher = watcher
-	if err := s.typedWatcher.Init(s); err != nil {
-		return errs.WithEF(err, s.fields, "Failed to init watcher")
-	}
 
 	if s.Name == "" {
 		s.Name = s.typedWatcher.GetServiceName()
@@ -88,8 +121,12 @@ func (s *Service) Init(router Router, synapse *Synapse) error {
 		s.typedRouterOptions = typedRouterOptions
 	}
 
-	if len([]byte(s.RouterOptions)) > 0 {
-		typedServerOptions, err := router.ParseServerOptions(s.ServerOptions)
+	serverOptions := s.ServerOptions
+	if len(serverOptions) == 0 {
+		serverOptions = router.getCommon().ServerOptions
+	}
+	if len(serverOptions) > 0 {
+		typedServerOptions, err := router.ParseServerOptions(serverOptions)
 		if err != nil {
 			return errs.WithEF(err, s.fields, "Failed to parse serverOptions")
 		}
@@ -99,8 +136,111 @@ func (s *Service) Init(router Router, synapse *Synapse) error {
 	if s.ServerSort == "" {
 		s.ServerSort = SORT_RANDOM
 	}
+	if s.ServerSort == SORT_ZONE && s.ServerSortLabel == "" {
+		s.ServerSortLabel = "az"
+	}
 
 	logs.WithF(s.fields).Info("Service loaded")
 	logs.WithF(s.fields.WithField("data", s)).Debug("Service loaded")
 	return nil
 }
+
+func (s *Service) validate(fields data.Fields, zone string) []error {
+	problems := []error{}
+	if s.MinimumHosts < 0 {
+		problems = append(problems, errs.WithF(fields, "MinimumHosts cannot be negative"))
+	}
+	if s.ServerSort == SORT_LABEL && s.ServerSortLabel == "" {
+		problems = append(problems, errs.WithF(fields, "ServerSortLabel is required with label serverSort"))
+	}
+	if s.ServerSort == SORT_ZONE && zone == "" {
+		problems = append(problems, errs.WithF(fields, "Zone is required in root configuration with zone serverSort"))
+	}
+	if s.MinAvailableRatio < 0 || s.MinAvailableRatio > 1 {
+		problems = append(problems, errs.WithF(fields.WithField("minAvailableRatio", s.MinAvailableRatio), "MinAvailableRatio must be between 0 and 1"))
+	}
+	return problems
+}
+
+// release resources of a service initialized but never watched. A running watcher releases them when stopped
+func (s *Service) close() {
+	if c, ok := s.typedWatcher.(connectionCloser); ok {
+		c.closeConnection()
+	}
+}
+
+const SERVER_STATE_AVAILABLE = "available"
+const SERVER_STATE_UNAVAILABLE = "unavailable"
+const SERVER_STATE_DISABLED = "disabled"
+const SERVER_STATE_BACKUP = "backup"
+
+// count servers by state. disabled are forced by api or by the minimum available ratio, backup are available with 'backup' in their haproxy server options
+func (s ServiceReport) serverStates() map[string]int {
+	states := map[string]int{
+		SERVER_STATE_AVAILABLE:   0,
+		SERVER_STATE_UNAVAILABLE: 0,
+		SERVER_STATE_DISABLED:    0,
+		SERVER_STATE_BACKUP:      0,
+	}
+	for _, report := range s.Reports {
+		if s.Disabled || report.disabled {
+			states[SERVER_STATE_DISABLED]++
+		} else if report.Available != nil && !*report.Available {
+			states[SERVER_STATE_UNAVAILABLE]++
+		} else if isBackupServer(report.HaProxyServerOptions) {
+			states[SERVER_STATE_BACKUP]++
+		} else {
+			states[SERVER_STATE_AVAILABLE]++
+		}
+	}
+	return states
+}
+
+func isBackupServer(options string) bool {
+	for _, option := range strings.Fields(options) {
+		if option == "backup" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) sortReports(reports *[]Report) {
+	if s.ServerSort == SORT_LABEL {
+		sortByLabel(reports, s.ServerSortLabel, s.ServerSortLabelOrder)
+		return
+	}
+	if s.ServerSort == SORT_ZONE {
+		sortByLabel(reports, s.ServerSortLabel, []string{s.synapse.Zone})
+		return
+	}
+	s.ServerSort.Sort(reports)
+}
+
+func (s *Service) applyDisabledServers(report *ServiceReport) {
+	if len(s.disabledServers) == 0 {
+		return
+	}
+
+	reports := make([]Report, len(report.Reports))
+	copy(reports, report.Reports)
+	present := make(map[string]struct{})
+	for i := range reports {
+		present[reports[i].Name] = struct{}{}
+		if _, ok := s.disabledServers[reports[i].Name]; ok {
+			available := false
+			weight := uint8(0)
+			reports[i].Available = &available
+			reports[i].Weight = &weight
+			reports[i].disabled = true
+		}
+	}
+	report.Reports = reports
+
+	for name := range s.disabledServers {
+		if _, ok := present[name]; !ok {
+			logs.WithF(s.fields.WithField("server", name)).Info("Disabled server is not discovered anymore. Removing override")
+			delete(s.disabledServers, name)
+		}
+	}
+}
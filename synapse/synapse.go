@@ -7,31 +7,54 @@ import (
 	"github.com/n0rad/go-erlog/logs"
 	"github.com/prometheus/client_golang/prometheus"
 	"net"
+	"os"
+	"sync"
+	"time"
 )
 
 type Synapse struct {
-	LogLevel *logs.Level
-	ApiHost  string
-	ApiPort  int
-	Routers  []json.RawMessage
+	LogLevel   *logs.Level
+	LogFormat  string
+	InstanceId string
+	ApiHost    string
+	ApiPort    int
+	Routers    []json.RawMessage
+	DryRun     bool
+	Zone       string // availability zone of this host, for zone server sort
 
 	serviceAvailableCount   *prometheus.GaugeVec
 	serviceUnavailableCount *prometheus.GaugeVec
 	routerUpdateFailures    *prometheus.GaugeVec
 	watcherFailures         *prometheus.GaugeVec
+	watcherLastEvent        *prometheus.GaugeVec
+	routerReloads           *prometheus.CounterVec
+	routerSocketCommands    *prometheus.CounterVec
+	routerConfigWrites      *prometheus.CounterVec
+	routerStateLoadFailures *prometheus.CounterVec
+	routerListenFailures    *prometheus.CounterVec
+	routerReloadsOnHold     *prometheus.GaugeVec
+	routerServerCount       *prometheus.GaugeVec
+	routerUpdateDuration    *prometheus.HistogramVec
+	backendServers          *prometheus.GaugeVec
 
 	fields           data.Fields
 	synapseVersion   string
 	synapseBuildTime string
 	apiListener      net.Listener
 	typedRouters     []Router
-	context          *ContextImpl
+	routerContexts   []*ContextImpl
+	oneshot          bool
+	reloadMutex      sync.Mutex
 }
 
 func (s *Synapse) Init(version string, buildTime string, logLevelIsSet bool) error {
 	s.synapseBuildTime = buildTime
 	s.synapseVersion = version
 
+	if problems := s.validate(); len(problems) > 0 {
+		return errs.With("Invalid configuration").WithErrs(problems...)
+	}
+
 	if s.ApiPort == 0 {
 		s.ApiPort = 3455
 	}
@@ -40,6 +63,92 @@ func (s *Synapse) Init(version string, buildTime string, logLevelIsSet bool) err
 		logs.SetLevel(*s.LogLevel)
 	}
 
+	if s.InstanceId == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errs.WithE(err, "Failed to get hostname for instanceId")
+		}
+		s.InstanceId = hostname
+	}
+	switch s.LogFormat {
+	case "", LOG_FORMAT_TEXT:
+	case LOG_FORMAT_JSON:
+		if err := useJsonLogs(os.Stderr, data.WithField("instance_id", s.InstanceId)); err != nil {
+			return errs.WithE(err, "Failed to set json log format")
+		}
+	}
+
+	s.initMetrics()
+
+	if err := prometheus.Register(s.watcherFailures); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus watcher_failure")
+	}
+
+	if err := prometheus.Register(s.watcherLastEvent); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus watcher_last_event_timestamp_seconds")
+	}
+
+	if err := prometheus.Register(s.serviceAvailableCount); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus service_available_count")
+	}
+
+	if err := prometheus.Register(s.serviceUnavailableCount); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus service_unavailable_count")
+	}
+
+	if err := prometheus.Register(s.routerUpdateFailures); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus router_update_failure")
+	}
+
+	if err := prometheus.Register(s.routerReloads); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus router_reload_total")
+	}
+
+	if err := prometheus.Register(s.routerSocketCommands); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus router_socket_command_total")
+	}
+
+	if err := prometheus.Register(s.routerConfigWrites); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus router_config_write_total")
+	}
+
+	if err := prometheus.Register(s.routerStateLoadFailures); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus router_state_load_failure_total")
+	}
+
+	if err := prometheus.Register(s.routerListenFailures); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus router_listen_verify_failure_total")
+	}
+
+	if err := prometheus.Register(s.routerReloadsOnHold); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus router_reloads_on_hold")
+	}
+
+	if err := prometheus.Register(s.routerServerCount); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus router_server_count")
+	}
+
+	if err := prometheus.Register(s.routerUpdateDuration); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus router_update_duration_seconds")
+	}
+
+	if err := prometheus.Register(s.backendServers); err != nil {
+		return errs.WithEF(err, s.fields, "Failed to register prometheus backend_servers")
+	}
+
+	for _, data := range s.Routers {
+		router, err := RouterFromJson(data, s)
+		if err != nil {
+			return errs.WithE(err, "Failed to init router")
+		}
+		s.typedRouters = append(s.typedRouters, router)
+	}
+
+	return nil
+}
+
+// metrics are created apart from their registration, that can only be done once per process
+func (s *Synapse) initMetrics() {
 	s.routerUpdateFailures = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "synapse",
@@ -68,47 +177,228 @@ func (s *Synapse) Init(version string, buildTime string, logLevelIsSet bool) err
 			Help:      "watcher failure",
 		}, []string{"service", "type"})
 
-	if err := prometheus.Register(s.watcherFailures); err != nil {
-		return errs.WithEF(err, s.fields, "Failed to register prometheus watcher_failure")
-	}
+	s.watcherLastEvent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "synapse",
+			Name:      "watcher_last_event_timestamp_seconds",
+			Help:      "time of the last event sent by watcher",
+		}, []string{"service"})
 
-	if err := prometheus.Register(s.serviceAvailableCount); err != nil {
-		return errs.WithEF(err, s.fields, "Failed to register prometheus service_available_count")
+	s.routerReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "synapse",
+			Name:      "router_reload_total",
+			Help:      "router reloads executed",
+		}, []string{"type"})
+
+	s.routerSocketCommands = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "synapse",
+			Name:      "router_socket_command_total",
+			Help:      "router socket commands sent",
+		}, []string{"type"})
+
+	s.routerConfigWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "synapse",
+			Name:      "router_config_write_total",
+			Help:      "router configuration file writes",
+		}, []string{"type"})
+
+	s.routerStateLoadFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "synapse",
+			Name:      "router_state_load_failure_total",
+			Help:      "router state file load failures",
+		}, []string{"type"})
+
+	s.routerListenFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "synapse",
+			Name:      "router_listen_verify_failure_total",
+			Help:      "router not listening after reload",
+		}, []string{"type"})
+
+	s.routerReloadsOnHold = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "synapse",
+			Name:      "router_reloads_on_hold",
+			Help:      "1 when router stopped reloading after too many consecutive failures",
+		}, []string{"type"})
+
+	s.routerServerCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "synapse",
+			Name:      "router_server_count",
+			Help:      "number of servers declared in router per service",
+		}, []string{"type", "service"})
+
+	s.routerUpdateDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "synapse",
+			Name:      "router_update_duration_seconds",
+			Help:      "time between discovery of a change and its application by the router",
+			Buckets:   []float64{.1, .25, .5, 1, 2, 5, 10, 30, 60},
+		}, []string{"type", "service"})
+
+	s.backendServers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "synapse",
+			Name:      "backend_servers",
+			Help:      "discovered servers per service by state",
+		}, []string{"service", "state"})
+}
+
+func (s *Synapse) Start(oneshot bool) error {
+	logs.Info("Starting synapse")
+
+	s.oneshot = oneshot
+	for _, router := range s.typedRouters {
+		s.routerContexts = append(s.routerContexts, s.startRouter(router))
 	}
+	return s.startApi()
+}
 
-	if err := prometheus.Register(s.serviceUnavailableCount); err != nil {
-		return errs.WithEF(err, s.fields, "Failed to register prometheus service_unavailable_count")
+func (s *Synapse) startRouter(router Router) *ContextImpl {
+	context := newContext(s.oneshot)
+	go router.Run(context)
+	return context
+}
+
+func stopRouter(context *ContextImpl) {
+	close(context.stop)
+	context.doneWaiter.Wait()
+}
+
+// apply a new configuration without restart. Only routers and services with a modified configuration are restarted.
+// A router whose own attributes changed is rebuilt with all its services, so their watchers restart too
+func (s *Synapse) Reload(conf *Synapse) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	logs.Info("Reloading synapse configuration")
+
+	if conf.ApiHost != s.ApiHost || (conf.ApiPort != 0 && conf.ApiPort != s.ApiPort) {
+		logs.WithF(s.fields).Warn("Api address modification requires a restart. Ignoring")
 	}
 
-	if err := prometheus.Register(s.routerUpdateFailures); err != nil {
-		return errs.WithEF(err, s.fields, "Failed to register prometheus router_update_failure")
+	newRouters := make([]Router, len(conf.Routers))
+	newServices := make([][]*Service, len(conf.Routers))
+	release := func() {
+		for i := range conf.Routers {
+			if newServices[i] != nil {
+				s.typedRouters[i].getCommon().releaseNewServices(newServices[i])
+			}
+			if newRouters[i] != nil {
+				releaseRouter(newRouters[i])
+			}
+		}
 	}
+	for i, content := range conf.Routers {
+		if i < len(s.Routers) && sameRouterConfig(s.Routers[i], content) {
+			router := s.typedRouters[i]
+			services, err := router.getCommon().prepareServices(router, content)
+			if err != nil {
+				release()
+				return errs.WithEF(err, s.fields.WithField("router", i), "Failed to prepare router services")
+			}
+			newServices[i] = services
+			continue
+		}
 
-	for _, data := range s.Routers {
-		router, err := RouterFromJson(data, s)
+		router, err := RouterFromJson(content, s)
 		if err != nil {
-			return errs.WithE(err, "Failed to init router")
+			release()
+			return errs.WithEF(err, s.fields.WithField("router", i), "Failed to init router")
 		}
-		s.typedRouters = append(s.typedRouters, router)
+		newRouters[i] = router
 	}
 
-	return nil
-}
+	for i := range conf.Routers {
+		if newRouters[i] == nil {
+			s.typedRouters[i].getCommon().updateServices(s.typedRouters[i], newServices[i])
+			continue
+		}
 
-func (s *Synapse) Start(oneshot bool) error {
-	logs.Info("Starting synapse")
+		if i < len(s.typedRouters) {
+			logs.WithF(s.typedRouters[i].getFields()).Warn("Router configuration changed. Restarting router and all its watchers")
+			stopRouter(s.routerContexts[i])
+			s.typedRouters[i] = newRouters[i]
+			s.routerContexts[i] = s.startRouter(newRouters[i])
+		} else {
+			logs.WithF(newRouters[i].getFields()).Info("Starting new router")
+			s.typedRouters = append(s.typedRouters, newRouters[i])
+			s.routerContexts = append(s.routerContexts, s.startRouter(newRouters[i]))
+		}
+	}
 
-	s.context = newContext(oneshot)
-	for _, routers := range s.typedRouters {
-		go routers.Run(s.context)
+	for i := len(conf.Routers); i < len(s.typedRouters); i++ {
+		logs.WithF(s.typedRouters[i].getFields()).Info("Router removed. Stopping router")
+		stopRouter(s.routerContexts[i])
 	}
-	return s.startApi()
+	s.typedRouters = s.typedRouters[:len(conf.Routers)]
+	s.routerContexts = s.routerContexts[:len(conf.Routers)]
+	s.Routers = conf.Routers
+	logs.Info("Synapse configuration reloaded")
+	return nil
 }
 
 func (s *Synapse) Stop() {
 	logs.Info("Stopping synapse")
 	s.stopApi()
-	close(s.context.stop)
-	s.context.doneWaiter.Wait()
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	for _, context := range s.routerContexts {
+		stopRouter(context)
+	}
 	logs.Debug("All router stopped")
+
+	for _, router := range s.typedRouters {
+		if c, ok := router.(stateCleaner); ok {
+			c.cleanStateOnShutdown()
+		}
+	}
+
+	var drainDuration time.Duration
+	for _, router := range s.typedRouters {
+		d, ok := router.(drainer)
+		if !ok {
+			continue
+		}
+		duration, err := d.drain()
+		if err != nil {
+			logs.WithEF(err, router.getFields()).Error("Failed to drain router")
+		}
+		if duration > drainDuration {
+			drainDuration = duration
+		}
+	}
+	if drainDuration > 0 {
+		logs.WithField("duration", drainDuration).Info("Waiting for connections to drain")
+		time.Sleep(drainDuration)
+	}
+}
+
+// closed once all routers handled a first report of each of their services
+func (s *Synapse) FirstRoundDone() <-chan struct{} {
+	done := make(chan struct{})
+	routers := append([]Router{}, s.typedRouters...)
+	go func() {
+		for _, router := range routers {
+			<-router.getCommon().firstRound
+		}
+		close(done)
+	}()
+	return done
+}
+
+// true if a router running in dry run would have applied a change
+func (s *Synapse) DryRunChanged() bool {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	for _, router := range s.typedRouters {
+		if d, ok := router.(dryRunner); ok && d.dryRunChanged() {
+			return true
+		}
+	}
+	return false
 }
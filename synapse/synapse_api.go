@@ -1,6 +1,7 @@
 package synapse
 
 import (
+	"encoding/json"
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -54,9 +56,54 @@ func (s *Synapse) startApi() error {
 		resp.Write([]byte("\n"))
 	})
 
+	m.Get("/services", s.ServicesStatus)
+	m.Get("/services/:name/status", s.ServiceDiscoveryStatus)
+	m.Post("/services/:name/servers/:server/disable", func(ctx *macaron.Context) (int, string) {
+		return s.setServerDisabled(ctx, true)
+	})
+	m.Post("/services/:name/servers/:server/enable", func(ctx *macaron.Context) (int, string) {
+		return s.setServerDisabled(ctx, false)
+	})
+	m.Post("/reload", s.forceReload)
+	m.Get("/config", s.renderedConfig)
+	m.Post("/pause", func() string {
+		s.reloadMutex.Lock()
+		defer s.reloadMutex.Unlock()
+		for _, router := range s.typedRouters {
+			router.getCommon().pause()
+		}
+		return "Paused\n"
+	})
+	m.Post("/resume", func() string {
+		s.reloadMutex.Lock()
+		defer s.reloadMutex.Unlock()
+		for _, router := range s.typedRouters {
+			router.getCommon().resume(router)
+		}
+		return "Resumed\n"
+	})
+	m.Get("/loglevel", func() string {
+		return strings.ToLower(logs.GetLevel().String()) + "\n"
+	})
+	m.Put("/loglevel", setLogLevel)
+	m.Get("/ready", s.Ready)
+	m.Get("/live", func() string {
+		return "OK\n"
+	})
 	m.Get("/metrics", prometheus.Handler())
 	m.Get("/", func() string {
-		return `/metrics
+		return `/services
+/services/:name/status
+/services/:name/servers/:server/disable (POST)
+/services/:name/servers/:server/enable (POST)
+/reload (POST)
+/config
+/pause (POST)
+/resume (POST)
+/loglevel (GET, PUT)
+/ready
+/live
+/metrics
 /version`
 	})
 
@@ -65,6 +112,308 @@ func (s *Synapse) startApi() error {
 	return nil
 }
 
+type ServiceStatus struct {
+	Router    string
+	Name      string
+	Watcher   string
+	LastEvent *time.Time `json:",omitempty"`
+	Paused    bool       // router updates are paused, servers are the ones applied before
+	Pending   bool       // a change was received while paused
+	Servers   []ServerStatus
+}
+
+type ServerStatus struct {
+	Name      string
+	Host      string
+	Port      int
+	Available bool
+	Disabled  bool
+	Weight    *uint8
+	Modified  *time.Time `json:",omitempty"` // last modification in the registry, when known
+}
+
+type DiscoveryStatus struct {
+	Router         string
+	Name           string
+	Watcher        string
+	Connected      bool       // last attempt to reach the registry succeeded
+	LastError      string     `json:",omitempty"`
+	LastErrorTime  *time.Time `json:",omitempty"`
+	LastEvent      *time.Time `json:",omitempty"`
+	Discovered     int
+	Available      int
+	RouterReported bool // servers were given to router
+}
+
+func (s *Synapse) ServiceDiscoveryStatus(ctx *macaron.Context) (int, string) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	name := ctx.Params(":name")
+	statuses := []DiscoveryStatus{}
+	for _, router := range s.typedRouters {
+		if status, ok := router.getCommon().discoveryStatus(name); ok {
+			statuses = append(statuses, status)
+		}
+	}
+	if len(statuses) == 0 {
+		return http.StatusNotFound, "Unknown service\n"
+	}
+	res, err := json.Marshal(statuses)
+	if err != nil {
+		logs.WithEF(err, s.fields).Error("Failed to marshal discovery status")
+		return http.StatusInternalServerError, "Failed to marshal discovery status\n"
+	}
+	ctx.Resp.Header().Set("Content-Type", "application/json")
+	return http.StatusOK, string(res)
+}
+
+func (r *RouterCommon) discoveryStatus(name string) (DiscoveryStatus, bool) {
+	r.handleMutex.Lock()
+	defer r.handleMutex.Unlock()
+
+	for _, service := range r.Services {
+		if service.Name != name {
+			continue
+		}
+		watcher := service.typedWatcher.getCommon()
+		status := DiscoveryStatus{
+			Router:    r.Type,
+			Name:      service.Name,
+			Watcher:   watcher.Type,
+			Connected: true,
+		}
+		if err, errorTime := watcher.getError(); err != nil {
+			status.Connected = false
+			status.LastError = err.Error()
+			status.LastErrorTime = &errorTime
+		}
+		if last := watcher.lastEventTime(); !last.IsZero() {
+			status.LastEvent = &last
+		}
+		if received, ok := r.lastReceived[service]; ok {
+			status.Discovered = len(received.Reports)
+			status.Available, _ = received.AvailableUnavailable()
+		}
+		_, status.RouterReported = r.lastEvents[service]
+		return status, true
+	}
+	return DiscoveryStatus{}, false
+}
+
+func (s *Synapse) renderedConfig() (int, string) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	renderers := []int{}
+	for i, router := range s.typedRouters {
+		if _, ok := router.(configRenderer); ok {
+			renderers = append(renderers, i)
+		}
+	}
+	if len(renderers) == 0 {
+		return http.StatusNotFound, "No router with a rendered configuration\n"
+	}
+
+	var buffer strings.Builder
+	for _, i := range renderers {
+		router := s.typedRouters[i]
+		config, err := router.(configRenderer).renderConfig()
+		if err != nil {
+			logs.WithEF(err, router.getFields()).Error("Failed to render configuration")
+			return http.StatusInternalServerError, "Failed to render configuration: " + err.Error() + "\n"
+		}
+		if len(renderers) > 1 {
+			buffer.WriteString("# router " + strconv.Itoa(i) + " " + router.getCommon().Type + "\n")
+		}
+		buffer.Write(config)
+	}
+	return http.StatusOK, buffer.String()
+}
+
+func (s *Synapse) forceReload() (int, string) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	var buffer strings.Builder
+	status := http.StatusOK
+	for _, router := range s.typedRouters {
+		reloader, ok := router.(forceReloader)
+		if !ok {
+			continue
+		}
+		fields := router.getFields()
+		if names := router.getCommon().notReportedServices(); len(names) > 0 {
+			// configuration would be missing servers
+			buffer.WriteString(router.getCommon().Type + ": skipped, services not reported yet: " + strings.Join(names, ", ") + "\n")
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		action, err := reloader.forceReload()
+		if err != nil {
+			logs.WithEF(err, fields).Error("Forced reload failed")
+			buffer.WriteString(router.getCommon().Type + ": failed: " + err.Error() + "\n")
+			status = http.StatusInternalServerError
+			continue
+		}
+		logs.WithF(fields.WithField("action", action)).Info("Forced reload")
+		buffer.WriteString(router.getCommon().Type + ": " + action + "\n")
+	}
+	if buffer.Len() == 0 {
+		return http.StatusOK, "No router to reload\n"
+	}
+	return status, buffer.String()
+}
+
+func (s *Synapse) setServerDisabled(ctx *macaron.Context, disabled bool) (int, string) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	name := ctx.Params(":name")
+	server := ctx.Params(":server")
+	serviceFound := false
+	serverFound := false
+	var buffer strings.Builder
+	for _, router := range s.typedRouters {
+		for _, service := range router.getCommon().Services {
+			if service.Name != name {
+				continue
+			}
+			serviceFound = true
+			found, err := router.getCommon().setServerDisabled(router, service, server, disabled)
+			if found {
+				serverFound = true
+			}
+			if err != nil {
+				buffer.WriteString(router.getCommon().Type + ": " + err.Error() + "\n")
+			}
+		}
+	}
+
+	if !serviceFound {
+		return http.StatusNotFound, "Unknown service\n"
+	}
+	if !serverFound {
+		return http.StatusNotFound, "Unknown server\n"
+	}
+	if buffer.Len() > 0 {
+		return http.StatusConflict, buffer.String()
+	}
+	return http.StatusOK, "OK\n"
+}
+
+func setLogLevel(ctx *macaron.Context) (int, string) {
+	body, err := ctx.Req.Body().Bytes()
+	if err != nil {
+		return http.StatusBadRequest, "Failed to read body\n"
+	}
+	request := struct {
+		Level string `json:"level"`
+	}{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return http.StatusBadRequest, "Invalid json body, expecting {\"level\":\"debug\"}\n"
+	}
+	level, err := logs.ParseLevel(request.Level)
+	if err != nil {
+		return http.StatusBadRequest, "Invalid log level, valid values: fatal, panic, error, warn, info, debug, trace\n"
+	}
+
+	logs.WithField("level", level).Info("Changing log level")
+	logs.SetLevel(level)
+	return http.StatusOK, "OK\n"
+}
+
+func (s *Synapse) Ready() (int, string) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	waiting := []string{}
+	for _, router := range s.typedRouters {
+		waiting = append(waiting, router.getCommon().notReportedServices()...)
+	}
+	if len(waiting) > 0 {
+		return http.StatusServiceUnavailable, "Waiting for first report of: " + strings.Join(waiting, ", ") + "\n"
+	}
+	return http.StatusOK, "OK\n"
+}
+
+func (r *RouterCommon) notReportedServices() []string {
+	r.handleMutex.Lock()
+	defer r.handleMutex.Unlock()
+
+	names := []string{}
+	for _, service := range r.Services {
+		if !service.typedWatcher.getCommon().hasReported() {
+			names = append(names, service.Name)
+		}
+	}
+	return names
+}
+
+func (s *Synapse) ServicesStatus(ctx *macaron.Context) (string, error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	statuses := []ServiceStatus{}
+	for _, router := range s.typedRouters {
+		statuses = append(statuses, router.getCommon().servicesStatus()...)
+	}
+	res, err := json.Marshal(statuses)
+	if err != nil {
+		return "", errs.WithEF(err, s.fields, "Failed to marshal services status")
+	}
+	ctx.Resp.Header().Set("Content-Type", "application/json")
+	return string(res), nil
+}
+
+func (r *RouterCommon) servicesStatus() []ServiceStatus {
+	r.handleMutex.Lock()
+	defer r.handleMutex.Unlock()
+
+	statuses := []ServiceStatus{}
+	for _, service := range r.Services {
+		status := ServiceStatus{
+			Router:  r.Type,
+			Name:    service.Name,
+			Watcher: service.typedWatcher.getCommon().Type,
+			Paused:  r.paused,
+			Servers: []ServerStatus{},
+		}
+		_, status.Pending = r.pendingEvents[service]
+		if last := service.typedWatcher.getCommon().lastEventTime(); !last.IsZero() {
+			status.LastEvent = &last
+		}
+		if event, ok := r.lastEvents[service]; ok {
+			for _, report := range event.Reports {
+				status.Servers = append(status.Servers, ServerStatus{
+					Name:      report.Name,
+					Host:      report.Host,
+					Port:      int(report.Port),
+					Available: report.Available == nil || *report.Available,
+					Disabled:  isDisabled(service, report.Name),
+					Weight:    report.Weight,
+					Modified:  modificationTime(report),
+				})
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func modificationTime(report Report) *time.Time {
+	if report.ModificationTime == 0 {
+		return nil
+	}
+	modified := time.Unix(0, report.ModificationTime*int64(time.Millisecond))
+	return &modified
+}
+
+func isDisabled(service *Service, server string) bool {
+	_, ok := service.disabledServers[server]
+	return ok
+}
+
 func (s *Synapse) stopApi() {
 	if s.apiListener != nil {
 		s.apiListener.Close()
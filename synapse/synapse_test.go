@@ -0,0 +1,84 @@
+package synapse
+
+import (
+	"bufio"
+	"github.com/blablacar/go-nerve/nerve"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// synapse with unregistered metrics, so tests can create as many as they need
+func newTestSynapse() *Synapse {
+	s := &Synapse{}
+	s.initMetrics()
+	return s
+}
+
+// router of a json configuration. Watchers are initialized but never started
+func newTestRouter(t *testing.T, s *Synapse, config string) Router {
+	router, err := RouterFromJson([]byte(config), s)
+	if err != nil {
+		t.Fatalf("Failed to create router: %s", err)
+	}
+	return router
+}
+
+const testWatcher = `{"type":"http","url":"http://127.0.0.1:1/servers"}`
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "synapse-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	return dir
+}
+
+func testServer(name string, host string, port int) Report {
+	available := true
+	return Report{Report: nerve.Report{Name: name, Host: host, Port: nerve.Port(port), Available: &available}}
+}
+
+func testWeight(weight uint8) *uint8 {
+	return &weight
+}
+
+func testBool(value bool) *bool {
+	return &value
+}
+
+func testInt(value int) *int {
+	return &value
+}
+
+func readTestFile(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("Failed to read %s: %s", path, err)
+	}
+	return string(content)
+}
+
+// haproxy stats socket answering every command with an empty line. Received lines are sent to commands
+func testSocket(t *testing.T, network string, address string) (net.Listener, <-chan string) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %s", address, err)
+	}
+	commands := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			commands <- strings.TrimSpace(line)
+			conn.Write([]byte("\n"))
+			conn.Close()
+		}
+	}()
+	return listener, commands
+}
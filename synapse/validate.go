@@ -0,0 +1,99 @@
+package synapse
+
+import (
+	"encoding/json"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// check configuration without starting anything, reporting all problems found.
+// Components are checked by the same validate functions run before their Init
+func (s *Synapse) Validate() error {
+	problems := s.validate()
+	if len(s.Routers) == 0 {
+		problems = append(problems, errs.With("No router configured"))
+	}
+
+	for i, content := range s.Routers {
+		problems = append(problems, validateRouter(content, s.Zone, data.WithField("router", i))...)
+	}
+
+	if len(problems) > 0 {
+		return errs.With("Invalid configuration").WithErrs(problems...)
+	}
+	return nil
+}
+
+func (s *Synapse) validate() []error {
+	problems := []error{}
+	if s.ApiPort < 0 || s.ApiPort > 65535 {
+		problems = append(problems, errs.WithF(data.WithField("apiPort", s.ApiPort), "Invalid api port"))
+	}
+	if s.LogFormat != "" && s.LogFormat != LOG_FORMAT_TEXT && s.LogFormat != LOG_FORMAT_JSON {
+		problems = append(problems, errs.WithF(data.WithField("logFormat", s.LogFormat), "Unsupported log format"))
+	}
+	return problems
+}
+
+func validateRouter(content []byte, zone string, fields data.Fields) []error {
+	common := RouterCommon{}
+	if err := json.Unmarshal(content, &common); err != nil {
+		return []error{errs.WithEF(err, fields, "Failed to unmarshall router")}
+	}
+	fields = fields.WithField("type", common.Type)
+
+	problems := []error{}
+	if router := newTypedRouter(common.Type); router == nil {
+		problems = append(problems, errs.WithF(fields, "Unsupported router type"))
+	} else if err := json.Unmarshal(content, &router); err != nil {
+		return []error{errs.WithEF(err, fields, "Failed to unmarshall router")}
+	} else {
+		problems = append(problems, router.validate(fields)...)
+	}
+
+	if len(common.Services) == 0 {
+		problems = append(problems, errs.WithF(fields, "No service configured"))
+	}
+	names := make(map[string]int)
+	for i, service := range common.Services {
+		serviceFields := fields.WithField("service", i)
+		problems = append(problems, service.validate(serviceFields, zone)...)
+		name, watcherProblems := validateWatcher(service.Watcher, serviceFields)
+		problems = append(problems, watcherProblems...)
+		if service.Name != "" {
+			name = service.Name
+		}
+		if name == "" {
+			continue
+		}
+		if previous, ok := names[name]; ok {
+			problems = append(problems, errs.WithF(serviceFields.WithField("name", name).WithField("previous", previous), "Duplicate service name"))
+		}
+		names[name] = i
+	}
+	return problems
+}
+
+// returns the service name the watcher would provide, empty if the watcher is invalid
+func validateWatcher(content []byte, fields data.Fields) (string, []error) {
+	if len(content) == 0 {
+		return "", []error{errs.WithF(fields, "Watcher is required")}
+	}
+	common := WatcherCommon{}
+	if err := json.Unmarshal(content, &common); err != nil {
+		return "", []error{errs.WithEF(err, fields, "Failed to unmarshall watcher")}
+	}
+	fields = fields.WithField("watcher", common.Type)
+
+	watcher := newTypedWatcher(common.Type)
+	if watcher == nil {
+		return "", []error{errs.WithF(fields, "Unsupported watcher type")}
+	}
+	if err := json.Unmarshal(content, &watcher); err != nil {
+		return "", []error{errs.WithEF(err, fields, "Failed to unmarshall watcher")}
+	}
+	if problems := watcher.validate(fields); len(problems) > 0 {
+		return "", problems
+	}
+	return watcher.GetServiceName(), nil
+}
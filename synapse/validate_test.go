@@ -0,0 +1,134 @@
+package synapse
+
+import (
+	"encoding/json"
+	"github.com/ghodss/yaml"
+	"github.com/n0rad/go-erlog/logs"
+	"testing"
+)
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	tests := []struct {
+		name     string
+		synapse  string
+		problems int
+	}{
+		{
+			name:     "valid",
+			synapse:  `{"routers":[{"type":"console","services":[{"watcher":` + testWatcher + `}]}]}`,
+			problems: 0,
+		},
+		{
+			name:     "no router",
+			synapse:  `{"apiPort":70000,"logFormat":"xml"}`,
+			problems: 3,
+		},
+		{
+			name:     "unsupported types",
+			synapse:  `{"routers":[{"type":"squid","services":[{"watcher":{"type":"consul"}}]}]}`,
+			problems: 2,
+		},
+		{
+			name: "haproxy without configPath and reloadCommand, dns watcher without port",
+			synapse: `{"routers":[{"type":"haproxy","socketCommandMode":"parallel",
+				"services":[{"watcher":{"type":"dns","host":"api.local"}}]}]}`,
+			problems: 4,
+		},
+		{
+			name: "invalid services",
+			synapse: `{"routers":[{"type":"console","services":[
+				{"name":"api","minimumHosts":-1,"minAvailableRatio":2,"watcher":` + testWatcher + `},
+				{"name":"api","serverSort":"zone","watcher":` + testWatcher + `},
+				{"serverSort":"label","watcher":{"type":"zookeeper","hosts":["127.0.0.1:2181"],"path":"services"}}]}]}`,
+			problems: 6,
+		},
+		{
+			name:     "router without service",
+			synapse:  `{"routers":[{"type":"template","destinationFile":"/tmp/servers","template":"a","templateFile":"b"}]}`,
+			problems: 2,
+		},
+		{
+			name: "ipvs and marathon",
+			synapse: `{"routers":[{"type":"ipvs",
+				"services":[{"watcher":{"type":"marathon","url":"http://127.0.0.1:8080","portIndex":-1}}]}]}`,
+			problems: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := Synapse{}
+			if err := json.Unmarshal([]byte(test.synapse), &s); err != nil {
+				t.Fatalf("Failed to unmarshal configuration: %s", err)
+			}
+
+			problems := s.validate()
+			if len(s.Routers) == 0 {
+				problems = append(problems, nil)
+			}
+			for _, router := range s.Routers {
+				problems = append(problems, validateRouter(router, s.Zone, nil)...)
+			}
+			if len(problems) != test.problems {
+				t.Errorf("Expected %d problems, got %d: %v", test.problems, len(problems), problems)
+			}
+			if err := s.Validate(); (err != nil) != (test.problems > 0) {
+				t.Errorf("Expected invalid configuration %t, got %v", test.problems > 0, err)
+			}
+		})
+	}
+}
+
+func TestRouterFromJsonUsesValidateChecks(t *testing.T) {
+	tests := []struct {
+		name   string
+		router string
+	}{
+		{name: "haproxy without configPath", router: `{"type":"haproxy","reloadCommand":["true"],"services":[{"watcher":` + testWatcher + `}]}`},
+		{name: "envoy without listenAddress", router: `{"type":"envoy","services":[{"watcher":` + testWatcher + `}]}`},
+		{name: "negative minimumHosts", router: `{"type":"console","services":[{"minimumHosts":-1,"watcher":` + testWatcher + `}]}`},
+		{name: "http watcher without url", router: `{"type":"console","services":[{"watcher":{"type":"http"}}]}`},
+		{name: "negative marathon portIndex", router: `{"type":"console","services":[{"watcher":{"type":"marathon","url":"http://127.0.0.1:8080","appId":"/api","portIndex":-1}}]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := RouterFromJson([]byte(test.router), newTestSynapse()); err == nil {
+				t.Errorf("Expected router to be rejected")
+			}
+		})
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		level string
+		err   bool
+	}{
+		{name: "trace", level: "trace"},
+		{name: "debug", level: "debug"},
+		{name: "info", level: "info"},
+		{name: "warn", level: "warn"},
+		{name: "error", level: "error"},
+		{name: "upper case", level: "INFO"},
+		{name: "unknown", level: "verbose", err: true},
+		{name: "empty", level: "''", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := Synapse{}
+			err := yaml.Unmarshal([]byte("logLevel: "+test.level), &s)
+			if (err != nil) != test.err {
+				t.Fatalf("Expected error %t, got %v", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if expected, _ := logs.ParseLevel(test.level); s.LogLevel == nil || *s.LogLevel != expected {
+				t.Errorf("Expected level %s, got %v", expected, s.LogLevel)
+			}
+		})
+	}
+}
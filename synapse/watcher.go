@@ -1,17 +1,36 @@
 package synapse
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 )
 
 type WatcherCommon struct {
-	Type string
+	Type                      string
+	LabelFilter               map[string]string
+	DeduplicateHosts          bool
+	ServerNameTemplate        string
+	StaleWarningInMilli       int
+	InitialReportDelayInMilli int
 
-	reports *reportMap
-	service *Service
-	fields  data.Fields
+	reports      *reportMap
+	service      *Service
+	fields       data.Fields
+	lastEvent    int64 // unix nano
+	lastSuccess  int64 // unix nano of last successful watch or poll of the registry
+	nameTemplate *template.Template
+	errorMutex   sync.Mutex
+	lastError    error
+	errorTime    time.Time
 }
 
 type Watcher interface {
@@ -19,19 +38,140 @@ type Watcher interface {
 	GetFields() data.Fields
 	Watch(context *ContextImpl, events chan<- ServiceReport, s *Service)
 	GetServiceName() string
+	getCommon() *WatcherCommon
+	validate(fields data.Fields) []error // checks of configuration done before Init, also used by Validate
+}
+
+// watchers the registry pushes changes to. Up to date without polling as long as connected
+type pushedWatcher interface {
+	isConnected() bool
+}
+
+// watchers connected to their registry from Init
+type connectionCloser interface {
+	closeConnection()
 }
 
 func (w *WatcherCommon) CommonInit(service *Service) error {
 	w.fields = data.WithField("type", w.Type)
 	w.service = service
 	w.reports = NewReportMap(service)
+	w.reports.labelFilter = w.LabelFilter
+	w.reports.deduplicateHosts = w.DeduplicateHosts
+
+	if w.ServerNameTemplate != "" {
+		tmpl, err := w.parseNameTemplate()
+		if err != nil {
+			return errs.WithEF(err, w.fields.WithField("template", w.ServerNameTemplate), "Failed to parse serverNameTemplate")
+		}
+		w.nameTemplate = tmpl
+	}
 	return nil
 }
 
+func (w *WatcherCommon) parseNameTemplate() (*template.Template, error) {
+	return template.New("server-name").Parse(w.ServerNameTemplate)
+}
+
+func (w *WatcherCommon) validateCommon(fields data.Fields) []error {
+	problems := []error{}
+	if w.ServerNameTemplate != "" {
+		if _, err := w.parseNameTemplate(); err != nil {
+			problems = append(problems, errs.WithEF(err, fields, "Invalid serverNameTemplate"))
+		}
+	}
+	return problems
+}
+
+// rename servers with the template. Names resolving to an already used one get an index suffix
+func (w *WatcherCommon) renameServers(reports []Report) []Report {
+	if w.nameTemplate == nil {
+		return reports
+	}
+
+	// stable order so the same servers always get the same suffix
+	sort.Sort(ByName{reports})
+	used := make(map[string]struct{})
+	for i := range reports {
+		var buffer bytes.Buffer
+		if err := w.nameTemplate.Execute(&buffer, reports[i]); err != nil {
+			logs.WithEF(err, w.fields.WithField("server", reports[i].Name)).Warn("Failed to template server name. Keeping original name")
+			used[reports[i].Name] = struct{}{}
+			continue
+		}
+		name := buffer.String()
+		if _, ok := used[name]; ok {
+			index := 1
+			for ; ; index++ {
+				if _, ok := used[name+"_"+strconv.Itoa(index)]; !ok {
+					break
+				}
+			}
+			logs.WithF(w.fields.WithField("server", reports[i].Name).WithField("name", name)).Warn("Templated server name already used. Adding index")
+			name = name + "_" + strconv.Itoa(index)
+		}
+		used[name] = struct{}{}
+		reports[i].Name = name
+	}
+	return reports
+}
+
 func (w *WatcherCommon) GetFields() data.Fields {
 	return w.fields
 }
 
+func (w *WatcherCommon) getCommon() *WatcherCommon {
+	return w
+}
+
+// true once the watcher sent its first report, even an empty one
+func (w *WatcherCommon) hasReported() bool {
+	return atomic.LoadInt64(&w.lastEvent) != 0
+}
+
+// keep the error of the last attempt to reach the registry, nil when it succeeded
+func (w *WatcherCommon) setError(err error) {
+	w.errorMutex.Lock()
+	defer w.errorMutex.Unlock()
+	if err == nil {
+		w.lastError = nil
+		atomic.StoreInt64(&w.lastSuccess, time.Now().UnixNano())
+		return
+	}
+	w.lastError = err
+	w.errorTime = time.Now()
+}
+
+func (w *WatcherCommon) getError() (error, time.Time) {
+	w.errorMutex.Lock()
+	defer w.errorMutex.Unlock()
+	return w.lastError, w.errorTime
+}
+
+// zero time if no event yet
+func (w *WatcherCommon) lastEventTime() time.Time {
+	last := atomic.LoadInt64(&w.lastEvent)
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// time since the registry was last successfully watched or polled, and whether it is more than staleWarningInMilli.
+// A connected pushed watcher with no error is never stale
+func (w *WatcherCommon) staleness() (time.Duration, bool) {
+	since := time.Since(time.Unix(0, atomic.LoadInt64(&w.lastSuccess)))
+	if w.StaleWarningInMilli <= 0 {
+		return since, false
+	}
+	if pushed, ok := w.service.typedWatcher.(pushedWatcher); ok && pushed.isConnected() {
+		if err, _ := w.getError(); err == nil {
+			return 0, false
+		}
+	}
+	return since, since > time.Duration(w.StaleWarningInMilli)*time.Millisecond
+}
+
 func WatcherFromJson(content []byte, service *Service) (Watcher, error) {
 	t := &WatcherCommon{}
 	if err := json.Unmarshal([]byte(content), t); err != nil {
@@ -39,11 +179,8 @@ func WatcherFromJson(content []byte, service *Service) (Watcher, error) {
 	}
 
 	fields := data.WithField("type", t.Type)
-	var typedWatcher Watcher
-	switch t.Type {
-	case "zookeeper":
-		typedWatcher = NewWatcherZookeeper()
-	default:
+	typedWatcher := newTypedWatcher(t.Type)
+	if typedWatcher == nil {
 		return nil, errs.WithF(fields, "Unsupported watcher type")
 	}
 
@@ -51,20 +188,88 @@ func WatcherFromJson(content []byte, service *Service) (Watcher, error) {
 		return nil, errs.WithEF(err, fields, "Failed to unmarshall watcher")
 	}
 
+	if problems := typedWatcher.validate(fields); len(problems) > 0 {
+		return nil, errs.WithF(fields, "Invalid watcher configuration").WithErrs(problems...)
+	}
 	if err := typedWatcher.Init(service); err != nil {
 		return nil, errs.WithEF(err, fields, "Failed to init watcher")
 	}
 	return typedWatcher, nil
 }
 
-func (w *WatcherZookeeper) changedToReport(reportsStop <-chan struct{}, events chan<- ServiceReport, s *Service) {
+// nil if type is not supported
+func newTypedWatcher(watcherType string) Watcher {
+	switch watcherType {
+	case "zookeeper":
+		return NewWatcherZookeeper()
+	case "http":
+		return NewWatcherHttp()
+	case "dns":
+		return NewWatcherDns()
+	case "marathon":
+		return NewWatcherMarathon()
+	}
+	return nil
+}
+
+func (w *WatcherCommon) changedToReport(reportsStop <-chan struct{}, events chan<- ServiceReport, s *Service) {
+	atomic.CompareAndSwapInt64(&w.lastSuccess, 0, time.Now().UnixNano())
+	var staleCheck <-chan time.Time
+	if w.StaleWarningInMilli > 0 {
+		ticker := time.NewTicker(time.Duration(w.StaleWarningInMilli) * time.Millisecond)
+		defer ticker.Stop()
+		staleCheck = ticker.C
+	}
+
+	if !w.gatherInitialReports(reportsStop) {
+		return
+	}
+	w.sendReport(events, s)
+
 	for {
 		select {
 		case <-w.reports.changed:
-			reports := w.reports.getValues()
-			events <- ServiceReport{Service: s, Reports: reports}
+			w.sendReport(events, s)
+		case <-staleCheck:
+			if since, stale := w.staleness(); stale {
+				logs.WithF(w.fields.WithField("service", s.Name).WithField("since", since)).Warn("Registry not successfully watched for a long time. Discovery may be frozen")
+			}
 		case <-reportsStop:
 			return
 		}
 	}
 }
+
+// wait for the watcher to enumerate all servers before the first report, so the first configuration is complete.
+// Returns false if stopped meanwhile
+func (w *WatcherCommon) gatherInitialReports(reportsStop <-chan struct{}) bool {
+	var delay <-chan time.Time
+	if w.InitialReportDelayInMilli > 0 {
+		delay = time.After(time.Duration(w.InitialReportDelayInMilli) * time.Millisecond)
+	}
+	for changed := false; ; {
+		select {
+		case <-w.reports.changed:
+			if delay == nil {
+				return true
+			}
+			changed = true
+		case <-delay:
+			if changed {
+				return true
+			}
+			delay = nil
+		case <-reportsStop:
+			return false
+		}
+	}
+}
+
+func (w *WatcherCommon) sendReport(events chan<- ServiceReport, s *Service) {
+	values, discoveryTime := w.reports.takeValues()
+	reports := w.renameServers(values)
+	now := time.Now()
+	events <- ServiceReport{Service: s, Reports: reports, DiscoveryTime: discoveryTime}
+	atomic.StoreInt64(&w.lastEvent, now.UnixNano())
+	s.synapse.watcherLastEvent.WithLabelValues(s.Name).Set(float64(now.Unix()))
+}
@@ -0,0 +1,136 @@
+package synapse
+
+import (
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PrometheusLabelDns = "dns"
+
+type WatcherDns struct {
+	WatcherCommon
+	Host            string
+	Port            int
+	PreferIpv4      bool
+	IntervalInMilli int
+
+	lookupIP func(host string) ([]net.IP, error)
+}
+
+func NewWatcherDns() *WatcherDns {
+	return &WatcherDns{
+		IntervalInMilli: 30000,
+		lookupIP:        net.LookupIP,
+	}
+}
+
+// haproxy server names do not accept the brackets of an ipv6 host:port
+var dnsServerNameReplacer = strings.NewReplacer(":", "_", ".", "_")
+
+func (w *WatcherDns) GetServiceName() string {
+	return strings.Replace(w.Host, ".", "_", -1) + "_" + strconv.Itoa(w.Port)
+}
+
+func (w *WatcherDns) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("host", w.Host).WithField("port", w.Port)
+	return nil
+}
+
+func (w *WatcherDns) validate(fields data.Fields) []error {
+	problems := w.validateCommon(fields)
+	if w.Host == "" {
+		problems = append(problems, errs.WithF(fields, "Host is required for dns watcher"))
+	}
+	if w.Port <= 0 || w.Port > 65535 {
+		problems = append(problems, errs.WithF(fields.WithField("port", w.Port), "Invalid port for dns watcher"))
+	}
+	if w.IntervalInMilli <= 0 {
+		problems = append(problems, errs.WithF(fields.WithField("interval", w.IntervalInMilli), "Invalid dns watcher interval"))
+	}
+	return problems
+}
+
+func (w *WatcherDns) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelDns).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	var previous []string
+	for {
+		ips, err := w.resolve()
+		w.setError(err)
+		if err != nil {
+			w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelDns).Inc()
+			logs.WithEF(err, w.fields).Warn("Failed to resolve servers. Keeping previous ones")
+		} else if previous == nil || strings.Join(ips, ",") != strings.Join(previous, ",") {
+			w.setServers(ips)
+			previous = ips
+		}
+
+		select {
+		case <-time.After(time.Duration(w.IntervalInMilli) * time.Millisecond):
+		case <-context.stop:
+			logs.WithF(w.fields).Debug("Stopping watcher")
+			close(reportsStop)
+			logs.WithF(w.fields).Debug("Watcher stopped")
+			return
+		}
+	}
+}
+
+// sorted addresses of the host. A name that does not exist resolves to no address
+func (w *WatcherDns) resolve() ([]string, error) {
+	ips, err := w.lookupIP(w.Host)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return []string{}, nil
+		}
+		return nil, errs.WithEF(err, w.fields, "Lookup failed")
+	}
+
+	hasIpv4 := false
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			hasIpv4 = true
+			break
+		}
+	}
+
+	addresses := []string{}
+	for _, ip := range ips {
+		if w.PreferIpv4 && hasIpv4 && ip.To4() == nil {
+			continue
+		}
+		addresses = append(addresses, ip.String())
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+func (w *WatcherDns) setServers(addresses []string) {
+	reports := make(map[string]Report)
+	available := true
+	for _, address := range addresses {
+		report := Report{}
+		report.Available = &available
+		report.Host = address
+		report.Port = nerve.Port(w.Port)
+		report.Name = dnsServerNameReplacer.Replace(address) + "_" + strconv.Itoa(w.Port)
+		reports[report.Name] = report
+	}
+	logs.WithF(w.fields.WithField("addresses", addresses)).Debug("Servers resolved")
+	w.reports.setReports(reports, time.Now().UnixNano()/int64(time.Millisecond))
+}
@@ -0,0 +1,86 @@
+package synapse
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// characters haproxy accepts in a server name
+var haproxyServerName = regexp.MustCompile(`^[a-zA-Z0-9_.:-]+$`)
+
+func TestDnsServers(t *testing.T) {
+	dualStack := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.1")}
+
+	tests := []struct {
+		name       string
+		ips        []net.IP
+		err        error
+		preferIpv4 bool
+		servers    string
+	}{
+		{name: "dual stack", ips: dualStack, servers: "10_0_0_1_80,2001_db8__1_80"},
+		{name: "prefer ipv4", ips: dualStack, preferIpv4: true, servers: "10_0_0_1_80"},
+		{name: "prefer ipv4 without ipv4", ips: []net.IP{net.ParseIP("2001:db8::1")}, preferIpv4: true, servers: "2001_db8__1_80"},
+		{name: "not found", err: &net.DNSError{Err: "no such host", Name: "api.local", IsNotFound: true}, servers: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := newTestRouter(t, newTestSynapse(), `{"type":"console","services":[{"name":"api","watcher":
+				{"type":"dns","host":"api.local","port":80,"preferIpv4":`+strconv.FormatBool(test.preferIpv4)+`}}]}`)
+			service := router.getCommon().Services[0]
+			service.typedWatcher.(*WatcherDns).lookupIP = func(host string) ([]net.IP, error) {
+				return test.ips, test.err
+			}
+			events, stop := startTestWatcher(service)
+			defer stop()
+
+			select {
+			case event := <-events:
+				names := []string{}
+				for _, report := range event.Reports {
+					names = append(names, report.Name)
+					if !haproxyServerName.MatchString(report.Name) {
+						t.Errorf("Expected a name valid in haproxy, got %s", report.Name)
+					}
+				}
+				sort.Strings(names)
+				if strings.Join(names, ",") != test.servers {
+					t.Errorf("Expected servers %s, got %v", test.servers, names)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected a report")
+			}
+		})
+	}
+}
+
+func TestDnsLookupErrorKeepsServers(t *testing.T) {
+	router := newTestRouter(t, newTestSynapse(), `{"type":"console","services":[{"name":"api","watcher":
+		{"type":"dns","host":"api.local","port":80,"intervalInMilli":10}}]}`)
+	service := router.getCommon().Services[0]
+	calls := make(chan struct{}, 100)
+	service.typedWatcher.(*WatcherDns).lookupIP = func(host string) ([]net.IP, error) {
+		calls <- struct{}{}
+		if len(calls) == 1 {
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		}
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	events, stop := startTestWatcher(service)
+	defer stop()
+
+	<-events
+	time.Sleep(100 * time.Millisecond)
+	if len(calls) < 3 {
+		t.Fatalf("Expected several lookups, got %d", len(calls))
+	}
+	if len(events) > 0 {
+		t.Errorf("Expected previous servers to be kept on lookup error, got %v", <-events)
+	}
+}
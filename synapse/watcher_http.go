@@ -0,0 +1,152 @@
+package synapse
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PrometheusLabelHttp = "http"
+
+type WatcherHttp struct {
+	WatcherCommon
+	Url             string
+	IntervalInMilli int
+	TimeoutInMilli  int
+
+	client   *http.Client
+	etag     string
+	lastBody []byte
+}
+
+func NewWatcherHttp() *WatcherHttp {
+	return &WatcherHttp{
+		IntervalInMilli: 5000,
+		TimeoutInMilli:  2000,
+	}
+}
+
+var nonNameChars = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+func (w *WatcherHttp) GetServiceName() string {
+	u, err := url.Parse(w.Url)
+	if err != nil {
+		return strings.Trim(nonNameChars.ReplaceAllString(w.Url, "_"), "_")
+	}
+	return strings.Trim(nonNameChars.ReplaceAllString(u.Host+u.Path, "_"), "_")
+}
+
+func (w *WatcherHttp) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("url", w.Url)
+	w.client = &http.Client{Timeout: time.Duration(w.TimeoutInMilli) * time.Millisecond}
+	return nil
+}
+
+func (w *WatcherHttp) validate(fields data.Fields) []error {
+	problems := w.validateCommon(fields)
+	if w.Url == "" {
+		problems = append(problems, errs.WithF(fields, "Url is required for http watcher"))
+	}
+	if w.IntervalInMilli <= 0 {
+		problems = append(problems, errs.WithF(fields.WithField("interval", w.IntervalInMilli), "Invalid http watcher interval"))
+	}
+	return problems
+}
+
+func (w *WatcherHttp) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelHttp).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	for {
+		err := w.poll()
+		w.setError(err)
+		if err != nil {
+			w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelHttp).Inc()
+			logs.WithEF(err, w.fields).Warn("Failed to get servers. Keeping previous ones")
+		}
+
+		select {
+		case <-time.After(time.Duration(w.IntervalInMilli) * time.Millisecond):
+		case <-context.stop:
+			logs.WithF(w.fields).Debug("Stopping watcher")
+			close(reportsStop)
+			logs.WithF(w.fields).Debug("Watcher stopped")
+			return
+		}
+	}
+}
+
+// servers are expected as a json array of nerve like reports
+func (w *WatcherHttp) poll() error {
+	req, err := http.NewRequest("GET", w.Url, nil)
+	if err != nil {
+		return errs.WithEF(err, w.fields, "Failed to prepare request")
+	}
+	if w.etag != "" {
+		req.Header.Set("If-None-Match", w.etag)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errs.WithEF(err, w.fields, "Request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		logs.WithF(w.fields).Trace("Servers not modified")
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errs.WithF(w.fields.WithField("status", resp.StatusCode), "Unexpected response status")
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errs.WithEF(err, w.fields, "Failed to read response")
+	}
+	if w.lastBody != nil && bytes.Equal(body, w.lastBody) {
+		logs.WithF(w.fields).Trace("Servers not modified")
+		w.etag = resp.Header.Get("ETag")
+		return nil
+	}
+
+	var contents []json.RawMessage
+	if err := json.Unmarshal(body, &contents); err != nil {
+		w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelContent).Inc()
+		return errs.WithEF(err, w.fields.WithField("content", string(body)), "Failed to unmarshal servers")
+	}
+
+	reports := make(map[string]Report)
+	for i, content := range contents {
+		report, ok := w.reports.parseRawReport(w.Url+"#"+strconv.Itoa(i), content, w.fields.WithField("server", i))
+		if !ok {
+			continue
+		}
+		if report.Name == "" {
+			report.Name = net.JoinHostPort(report.Host, strconv.Itoa(int(report.Port)))
+		}
+		reports[report.Name] = report
+	}
+	w.reports.setReports(reports, time.Now().UnixNano()/int64(time.Millisecond))
+
+	w.lastBody = body
+	w.etag = resp.Header.Get("ETag")
+	return nil
+}
@@ -0,0 +1,105 @@
+package synapse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testHttpResponse struct {
+	status int
+	etag   string
+	body   string
+}
+
+func TestHttpWatcher(t *testing.T) {
+	api1 := `[{"name":"api1","host":"10.0.0.1","port":80}]`
+	api2 := `[{"name":"api1","host":"10.0.0.1","port":80},{"name":"api2","host":"10.0.0.2","port":80}]`
+
+	tests := []struct {
+		name        string
+		responses   []testHttpResponse // the last one is repeated
+		reports     []string
+		ifNoneMatch string
+	}{
+		{
+			name:        "not modified with etag",
+			responses:   []testHttpResponse{{status: 200, etag: "v1", body: api1}, {status: 304}},
+			reports:     []string{"api1"},
+			ifNoneMatch: "v1",
+		},
+		{
+			name:      "non 200 keeps previous servers",
+			responses: []testHttpResponse{{status: 200, body: api1}, {status: 503, body: "[]"}},
+			reports:   []string{"api1"},
+		},
+		{
+			name:      "unchanged body",
+			responses: []testHttpResponse{{status: 200, body: api1}, {status: 200, body: api1}},
+			reports:   []string{"api1"},
+		},
+		{
+			name:      "changed body",
+			responses: []testHttpResponse{{status: 200, body: api1}, {status: 200, body: api2}},
+			reports:   []string{"api1", "api1,api2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mutex := sync.Mutex{}
+			requests := 0
+			ifNoneMatch := []string{}
+			registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				response := test.responses[len(test.responses)-1]
+				if requests < len(test.responses) {
+					response = test.responses[requests]
+				}
+				requests++
+				ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+				mutex.Unlock()
+
+				if response.etag != "" {
+					w.Header().Set("ETag", response.etag)
+				}
+				w.WriteHeader(response.status)
+				w.Write([]byte(response.body))
+			}))
+			defer registry.Close()
+
+			router := newTestRouter(t, newTestSynapse(), `{"type":"console","services":[{"name":"api","watcher":
+				{"type":"http","url":"`+registry.URL+`","intervalInMilli":10}}]}`)
+			events, stop := startTestWatcher(router.getCommon().Services[0])
+			time.Sleep(200 * time.Millisecond)
+			stop()
+
+			reports := []string{}
+			for len(events) > 0 {
+				event := <-events
+				names := []string{}
+				for _, report := range event.Reports {
+					names = append(names, report.Name)
+				}
+				sort.Strings(names)
+				reports = append(reports, strings.Join(names, ","))
+			}
+			if strings.Join(reports, " ") != strings.Join(test.reports, " ") {
+				t.Errorf("Expected reports %v, got %v", test.reports, reports)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if requests < 3 {
+				t.Fatalf("Expected the watcher to poll several times, got %d requests", requests)
+			}
+			if test.ifNoneMatch != "" && ifNoneMatch[len(ifNoneMatch)-1] != test.ifNoneMatch {
+				t.Errorf("Expected If-None-Match %s, got %v", test.ifNoneMatch, ifNoneMatch)
+			}
+		})
+	}
+}
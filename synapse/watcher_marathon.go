@@ -0,0 +1,261 @@
+package synapse
+
+import (
+	"bufio"
+	gocontext "context"
+	"encoding/json"
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const PrometheusLabelMarathon = "marathon"
+
+type WatcherMarathon struct {
+	WatcherCommon
+	Url             string
+	AppId           string
+	PortIndex       int
+	EventStream     *bool
+	IntervalInMilli int
+	TimeoutInMilli  int
+
+	client      *http.Client
+	lastReports map[string]Report
+}
+
+type marathonTasks struct {
+	Tasks []marathonTask `json:"tasks"`
+}
+
+type marathonTask struct {
+	Id                 string `json:"id"`
+	Host               string `json:"host"`
+	Ports              []int  `json:"ports"`
+	State              string `json:"state"`
+	StartedAt          string `json:"startedAt"`
+	HealthCheckResults []struct {
+		Alive bool `json:"alive"`
+	} `json:"healthCheckResults"`
+}
+
+func NewWatcherMarathon() *WatcherMarathon {
+	return &WatcherMarathon{
+		IntervalInMilli: 30000,
+		TimeoutInMilli:  2000,
+	}
+}
+
+func (w *WatcherMarathon) GetServiceName() string {
+	return strings.Trim(nonNameChars.ReplaceAllString(w.AppId, "_"), "_")
+}
+
+func (w *WatcherMarathon) Init(service *Service) error {
+	if err := w.CommonInit(service); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to init discovery")
+	}
+	w.fields = w.fields.WithField("url", w.Url).WithField("app", w.AppId)
+
+	if !strings.HasPrefix(w.AppId, "/") {
+		w.AppId = "/" + w.AppId
+	}
+	w.Url = strings.TrimSuffix(w.Url, "/")
+	if w.EventStream == nil {
+		enabled := true
+		w.EventStream = &enabled
+	}
+	w.client = &http.Client{Timeout: time.Duration(w.TimeoutInMilli) * time.Millisecond}
+	return nil
+}
+
+func (w *WatcherMarathon) validate(fields data.Fields) []error {
+	problems := w.validateCommon(fields)
+	if w.Url == "" {
+		problems = append(problems, errs.WithF(fields, "Url is required for marathon watcher"))
+	}
+	if w.AppId == "" {
+		problems = append(problems, errs.WithF(fields, "AppId is required for marathon watcher"))
+	}
+	if w.PortIndex < 0 {
+		problems = append(problems, errs.WithF(fields.WithField("portIndex", w.PortIndex), "Invalid marathon port index"))
+	}
+	if w.IntervalInMilli <= 0 {
+		problems = append(problems, errs.WithF(fields.WithField("interval", w.IntervalInMilli), "Invalid marathon watcher interval"))
+	}
+	return problems
+}
+
+func (w *WatcherMarathon) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
+	context.doneWaiter.Add(1)
+	defer context.doneWaiter.Done()
+	w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelMarathon).Set(0)
+
+	reportsStop := make(chan struct{})
+	go w.changedToReport(reportsStop, events, s)
+
+	changed := make(chan struct{}, 1)
+	if *w.EventStream {
+		go w.streamEvents(context.stop, changed)
+	}
+
+	for {
+		err := w.poll()
+		w.setError(err)
+		if err != nil {
+			w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelMarathon).Inc()
+			logs.WithEF(err, w.fields).Warn("Failed to get marathon tasks. Keeping previous ones")
+		}
+
+		select {
+		case <-changed:
+			logs.WithF(w.fields).Debug("Marathon event received for app")
+		case <-time.After(time.Duration(w.IntervalInMilli) * time.Millisecond):
+		case <-context.stop:
+			logs.WithF(w.fields).Debug("Stopping watcher")
+			close(reportsStop)
+			logs.WithF(w.fields).Debug("Watcher stopped")
+			return
+		}
+	}
+}
+
+// follow marathon event bus and notify on events of the app. Tasks are fully polled again on each notification,
+// so nothing is lost while reconnecting
+func (w *WatcherMarathon) streamEvents(stop <-chan struct{}, changed chan<- struct{}) {
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	for {
+		err := w.readEvents(ctx, notify)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		logs.WithEF(err, w.fields).Warn("Marathon event stream ended. Reconnecting")
+		notify()
+
+		select {
+		case <-time.After(time.Duration(w.TimeoutInMilli) * time.Millisecond):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *WatcherMarathon) readEvents(ctx gocontext.Context, notify func()) error {
+	req, err := http.NewRequest("GET", w.Url+"/v2/events", nil)
+	if err != nil {
+		return errs.WithEF(err, w.fields, "Failed to prepare event stream request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req) // no timeout, the stream stays open
+	if err != nil {
+		return errs.WithEF(err, w.fields, "Failed to connect to event stream")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errs.WithF(w.fields.WithField("status", resp.StatusCode), "Unexpected event stream status")
+	}
+
+	appId := `"appId":"` + w.AppId + `"`
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		if strings.Contains(strings.Replace(line, " ", "", -1), appId) {
+			notify()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errs.WithEF(err, w.fields, "Failed to read event stream")
+	}
+	return errs.WithF(w.fields, "Event stream closed")
+}
+
+func (w *WatcherMarathon) poll() error {
+	req, err := http.NewRequest("GET", w.Url+"/v2/apps"+w.AppId+"/tasks", nil)
+	if err != nil {
+		return errs.WithEF(err, w.fields, "Failed to prepare request")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errs.WithEF(err, w.fields, "Request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errs.WithF(w.fields.WithField("status", resp.StatusCode), "Unexpected response status")
+	}
+
+	tasks := marathonTasks{}
+	if err := json.NewDecoder(resp.Body).Decode(&tasks); err != nil {
+		w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelContent).Inc()
+		return errs.WithEF(err, w.fields, "Failed to unmarshal marathon tasks")
+	}
+
+	reports := make(map[string]Report)
+	for _, task := range tasks.Tasks {
+		if len(task.Ports) <= w.PortIndex {
+			logs.WithF(w.fields.WithField("task", task.Id).WithField("portIndex", w.PortIndex)).Warn("Task has no port at index. Ignoring")
+			continue
+		}
+		available := task.isAvailable()
+		report := Report{Report: nerve.Report{
+			Available: &available,
+			Host:      task.Host,
+			Port:      nerve.Port(task.Ports[w.PortIndex]),
+			Name:      task.Id,
+		}}
+		if !available {
+			weight := uint8(0)
+			report.Weight = &weight
+		}
+		reports[task.Id] = report
+	}
+	if w.lastReports != nil && reflect.DeepEqual(reports, w.lastReports) {
+		logs.WithF(w.fields).Trace("Tasks not modified")
+		return nil
+	}
+	w.reports.setReports(reports, time.Now().UnixNano()/int64(time.Millisecond))
+	w.lastReports = reports
+	return nil
+}
+
+// running, with all health checks passing. Older marathon versions do not report state
+func (t marathonTask) isAvailable() bool {
+	if t.State != "" && t.State != "TASK_RUNNING" {
+		return false
+	}
+	if t.State == "" && t.StartedAt == "" {
+		return false
+	}
+	for _, result := range t.HealthCheckResults {
+		if !result.Alive {
+			return false
+		}
+	}
+	return true
+}
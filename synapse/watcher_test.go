@@ -0,0 +1,53 @@
+package synapse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStalenessFromLastSuccessfulPoll(t *testing.T) {
+	var failing int32
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "v1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", "v1")
+		w.Write([]byte(`[{"name":"api1","host":"10.0.0.1","port":80}]`))
+	}))
+	defer registry.Close()
+
+	router := newTestRouter(t, newTestSynapse(), `{"type":"console","services":[{"name":"api","watcher":
+		{"type":"http","url":"`+registry.URL+`","intervalInMilli":10,"staleWarningInMilli":100}}]}`)
+	service := router.getCommon().Services[0]
+	watcher := service.typedWatcher.getCommon()
+	events := make(chan ServiceReport, 10)
+	context := newContext(false)
+	go service.typedWatcher.Watch(context, events, service)
+	defer func() {
+		close(context.stop)
+		context.doneWaiter.Wait()
+	}()
+
+	<-events
+	time.Sleep(300 * time.Millisecond)
+	if since, stale := watcher.staleness(); stale {
+		t.Errorf("Expected unchanged servers polled successfully not to be stale, got %s since last success", since)
+	}
+	if len(events) > 0 {
+		t.Errorf("Expected no report for unchanged servers, got %d", len(events))
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	time.Sleep(300 * time.Millisecond)
+	if since, stale := watcher.staleness(); !stale {
+		t.Errorf("Expected failing polls to be stale, got %s since last success", since)
+	}
+}
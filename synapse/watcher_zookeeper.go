@@ -1,10 +1,15 @@
 package synapse
 
 import (
-	"github.com/blablacar/go-nerve/nerve"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
 	"github.com/samuel/go-zookeeper/zk"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -14,40 +19,141 @@ const PrometheusLabelWatch = "watch"
 
 type WatcherZookeeper struct {
 	WatcherCommon
-	Hosts          []string
-	Path           string
-	TimeoutInMilli int
+	Hosts                  []string
+	Path                   string
+	Paths                  []string
+	TimeoutInMilli         int
+	RetryMinBackoffInMilli int
+	RetryMaxBackoffInMilli int
+	MaxConcurrentNodeReads int
+	RootDeleteGraceInMilli int
+	Tls                    *ZkTls // dedicated connection instead of the one shared by watchers of same hosts
 
-	connection       *nerve.SharedZkConnection
-	connectionEvents <-chan zk.Event
+	connection      *zkConnection // nil with tls
+	conn            *zk.Conn
+	nodeReads       chan struct{} // semaphore of node reads in flight, nil if unbounded
+	watchedMutex    sync.Mutex
+	watchedNodes    map[string]struct{}
+	removalsMutex   sync.Mutex
+	pendingRemovals map[string]*time.Timer // removals waiting for rootDeleteGraceInMilli
+	removals        sync.WaitGroup         // pending or running removals
+}
+
+type ZkTls struct {
+	CaFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string // default to the host connected to
+	InsecureSkipVerify bool
 }
 
 func NewWatcherZookeeper() *WatcherZookeeper {
 	w := &WatcherZookeeper{
-		TimeoutInMilli: 2000,
+		TimeoutInMilli:         2000,
+		RetryMinBackoffInMilli: 1000,
+		RetryMaxBackoffInMilli: 30000,
 	}
 	return w
 }
 
 func (w *WatcherZookeeper) GetServiceName() string {
-	return strings.Replace(w.Path, "/", "_", -1)[1:]
+	names := []string{}
+	for _, path := range w.allPaths() {
+		names = append(names, strings.Replace(path, "/", "_", -1)[1:])
+	}
+	return strings.Join(names, "_")
+}
+
+func (w *WatcherZookeeper) allPaths() []string {
+	if w.Path == "" {
+		return w.Paths
+	}
+	return append([]string{w.Path}, w.Paths...)
 }
 
 func (w *WatcherZookeeper) Init(service *Service) error {
 	if err := w.CommonInit(service); err != nil {
 		return errs.WithEF(err, w.fields, "Failed to init discovery")
 	}
-	w.fields = w.fields.WithField("path", w.Path)
+	w.fields = w.fields.WithField("path", strings.Join(w.allPaths(), ","))
 
-	conn, err := nerve.NewSharedZkConnection(w.Hosts, time.Duration(w.TimeoutInMilli)*time.Millisecond)
-	if err != nil {
-		return errs.WithEF(err, w.fields, "Failed to prepare connection to zookeeper")
+	if w.Tls != nil {
+		config, err := w.Tls.config()
+		if err != nil {
+			return errs.WithEF(err, w.fields, "Failed to load zookeeper tls configuration")
+		}
+		// the dialer is used again on each reconnection
+		dialer := func(network string, address string, timeout time.Duration) (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, config)
+		}
+		conn, _, err := zk.Connect(w.Hosts, time.Duration(w.TimeoutInMilli)*time.Millisecond, zk.WithDialer(dialer), withZkLogger)
+		if err != nil {
+			return errs.WithEF(err, w.fields, "Failed to prepare tls connection to zookeeper")
+		}
+		w.conn = conn
+	} else {
+		connection, err := acquireZkConnection(w.Hosts, time.Duration(w.TimeoutInMilli)*time.Millisecond)
+		if err != nil {
+			return errs.WithEF(err, w.fields, "Failed to prepare connection to zookeeper")
+		}
+		w.connection = connection
+		w.conn = connection.conn
+	}
+	w.watchedNodes = make(map[string]struct{})
+	w.pendingRemovals = make(map[string]*time.Timer)
+	if w.MaxConcurrentNodeReads > 0 {
+		w.nodeReads = make(chan struct{}, w.MaxConcurrentNodeReads)
 	}
-	w.connection = conn
-	w.connectionEvents = w.connection.Subscribe()
 	return nil
 }
 
+func (w *WatcherZookeeper) validate(fields data.Fields) []error {
+	problems := w.validateCommon(fields)
+	if len(w.Hosts) == 0 {
+		problems = append(problems, errs.WithF(fields, "Hosts are required for zookeeper watcher"))
+	}
+	if w.RetryMinBackoffInMilli <= 0 || w.RetryMaxBackoffInMilli < w.RetryMinBackoffInMilli {
+		problems = append(problems, errs.WithF(fields.WithField("min", w.RetryMinBackoffInMilli).WithField("max", w.RetryMaxBackoffInMilli), "Invalid zookeeper retry backoff"))
+	}
+	if len(w.allPaths()) == 0 {
+		problems = append(problems, errs.WithF(fields, "Path or Paths is required for zookeeper watcher"))
+	}
+	for _, path := range w.allPaths() {
+		if !strings.HasPrefix(path, "/") || len(path) < 2 {
+			problems = append(problems, errs.WithF(fields.WithField("path", path), "Invalid zookeeper path"))
+		}
+	}
+	if w.Tls != nil && (w.Tls.CertFile == "") != (w.Tls.KeyFile == "") {
+		problems = append(problems, errs.WithF(fields, "CertFile and KeyFile of zookeeper tls go together"))
+	}
+	return problems
+}
+
+func (t *ZkTls) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CaFile != "" {
+		ca, err := ioutil.ReadFile(t.CaFile)
+		if err != nil {
+			return nil, errs.WithEF(err, data.WithField("file", t.CaFile), "Failed to read ca certificate")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errs.WithF(data.WithField("file", t.CaFile), "No valid certificate in ca file")
+		}
+	}
+	if t.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, errs.WithEF(err, data.WithField("cert", t.CertFile).WithField("key", t.KeyFile), "Failed to load client certificate")
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
 func (w *WatcherZookeeper) Watch(context *ContextImpl, events chan<- ServiceReport, s *Service) {
 	context.doneWaiter.Add(1)
 	defer context.doneWaiter.Done()
@@ -58,40 +164,62 @@ func (w *WatcherZookeeper) Watch(context *ContextImpl, events chan<- ServiceRepo
 
 	watcherStop := make(chan struct{})
 	watcherStopWaiter := sync.WaitGroup{}
-	go w.watchRoot(watcherStop, &watcherStopWaiter)
+	for _, path := range w.allPaths() {
+		go w.watchRoot(path, watcherStop, &watcherStopWaiter)
+	}
 
 	<-context.stop
 	logs.WithF(w.fields).Debug("Stopping watcher")
 	close(watcherStop)
 	watcherStopWaiter.Wait()
-	w.connection.Close()
+	w.cancelAllRemovals()
+	w.removals.Wait() // a running removal sends its change, so reports must still be consumed
+	w.closeConnection()
 	close(reportsStop)
 	logs.WithF(w.fields).Debug("Watcher stopped")
 }
 
-func (w *WatcherZookeeper) watchRoot(stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
+// watches stay armed as long as the session is
+func (w *WatcherZookeeper) isConnected() bool {
+	return w.conn != nil && w.conn.State() == zk.StateHasSession
+}
+
+func (w *WatcherZookeeper) closeConnection() {
+	if w.connection != nil {
+		releaseZkConnection(w.connection)
+	} else if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+func (w *WatcherZookeeper) watchRoot(path string, stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
 	doneWaiter.Add(1)
 	defer doneWaiter.Done()
 
+	failures := 0
 	for {
-		childs, _, rootEvents, err := w.connection.Conn.ChildrenW(w.Path)
+		childs, _, rootEvents, err := w.conn.ChildrenW(path)
+		w.setError(err)
 		if err != nil {
 			w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Inc()
-			logs.WithEF(err, w.fields.WithField("path", w.Path)).Warn("Cannot watch root service path. Retry in 1s")
-			<-time.After(time.Duration(1000) * time.Millisecond)
-
-			if isStopped(stop) {
+			backoff := w.retryBackoff(failures)
+			failures++
+			logs.WithEF(err, w.fields.WithField("path", path).WithField("retry", backoff)).Warn("Cannot watch root service path")
+			if !waitOrStop(backoff, stop) {
 				return
 			}
 			continue
 		}
+		failures = 0
 
 		if len(childs) == 0 {
-			w.reports.setNoNodes()
+			w.removeAfterGrace(path+"/", func() { w.reports.removePrefix(path + "/") })
 		} else {
+			w.cancelRemoval(path + "/")
 			for _, child := range childs {
-				if _, ok := w.reports.get(w.Path + "/" + child); !ok {
-					go w.watchNode(w.Path+"/"+child, stop, doneWaiter)
+				if w.startWatchingNode(path + "/" + child) {
+					doneWaiter.Add(1)
+					go w.watchNode(path+"/"+child, stop, doneWaiter)
 				}
 			}
 		}
@@ -107,11 +235,11 @@ func (w *WatcherZookeeper) watchRoot(stop <-chan struct{}, doneWaiter *sync.Wait
 		case e := <-rootEvents:
 			logs.WithF(w.fields.WithField("event", e)).Trace("Receiving event for root node")
 			switch e.Type {
-			case zk.EventNodeChildrenChanged | zk.EventNodeCreated | zk.EventNodeDataChanged | zk.EventNotWatching:
+			case zk.EventNodeChildrenChanged, zk.EventNodeCreated, zk.EventNodeDataChanged, zk.EventNotWatching:
 			// loop
 			case zk.EventNodeDeleted:
-				logs.WithF(w.fields.WithField("node", w.Path)).Debug("Rootnode deleted")
-				w.reports.removeAll()
+				logs.WithF(w.fields.WithField("node", path)).Debug("Rootnode deleted")
+				w.removeAfterGrace(path+"/", func() { w.reports.removePrefix(path + "/") })
 			}
 		case <-stop:
 			return
@@ -119,32 +247,70 @@ func (w *WatcherZookeeper) watchRoot(stop <-chan struct{}, doneWaiter *sync.Wait
 	}
 }
 
+// true if the node was not watched yet. Nodes stay watched until their watcher returns
+func (w *WatcherZookeeper) startWatchingNode(node string) bool {
+	w.watchedMutex.Lock()
+	defer w.watchedMutex.Unlock()
+	if _, ok := w.watchedNodes[node]; ok {
+		return false
+	}
+	w.watchedNodes[node] = struct{}{}
+	return true
+}
+
+func (w *WatcherZookeeper) stopWatchingNode(node string) {
+	w.watchedMutex.Lock()
+	defer w.watchedMutex.Unlock()
+	delete(w.watchedNodes, node)
+}
+
+// read node and set a watch, waiting for a free slot when concurrent reads are bounded
+func (w *WatcherZookeeper) getNode(node string, stop <-chan struct{}) ([]byte, *zk.Stat, <-chan zk.Event, bool, error) {
+	if w.nodeReads != nil {
+		select {
+		case w.nodeReads <- struct{}{}:
+			defer func() { <-w.nodeReads }()
+		case <-stop:
+			return nil, nil, nil, false, nil
+		}
+	}
+	content, stats, events, err := w.conn.GetW(node)
+	return content, stats, events, true, err
+}
+
 func (w *WatcherZookeeper) watchNode(node string, stop <-chan struct{}, doneWaiter *sync.WaitGroup) {
-	doneWaiter.Add(1)
 	defer doneWaiter.Done()
+	defer w.stopWatchingNode(node)
 
 	fields := w.fields.WithField("node", node)
 	logs.WithF(fields).Debug("New node watcher")
 
+	failures := 0
 	for {
-		content, stats, childEvent, err := w.connection.Conn.GetW(node)
+		content, stats, childEvent, ok, err := w.getNode(node, stop)
+		if !ok {
+			return
+		}
 		if err != nil {
 			if err == zk.ErrNoNode {
 				logs.WithEF(err, fields).Warn("Node disappear before watching")
-				w.reports.removeNode(node)
+				w.removeAfterGrace(node, func() { w.reports.removeNode(node) })
 				return
 			}
 			w.service.synapse.watcherFailures.WithLabelValues(w.service.Name, PrometheusLabelWatch).Inc()
-			logs.WithEF(err, fields).Warn("Failed to watch node, retry in 1s")
-			<-time.After(time.Duration(1000) * time.Millisecond)
-
-			if isStopped(stop) {
+			w.setError(err)
+			backoff := w.retryBackoff(failures)
+			failures++
+			logs.WithEF(err, fields.WithField("retry", backoff)).Warn("Failed to watch node")
+			if !waitOrStop(backoff, stop) {
 				return
 			}
 			continue
 		}
+		failures = 0
 
-		w.reports.addRawReport(node, content, fields, stats.Ctime)
+		w.cancelRemoval(node)
+		w.reports.addRawReport(node, content, fields, stats)
 
 		//if context.oneshot {
 		//	go func() {
@@ -157,11 +323,11 @@ func (w *WatcherZookeeper) watchNode(node string, stop <-chan struct{}, doneWait
 		case e := <-childEvent:
 			logs.WithF(fields.WithField("event", e)).Trace("Receiving event from node")
 			switch e.Type {
-			case zk.EventNodeDataChanged | zk.EventNodeCreated | zk.EventNotWatching:
-			// loop
+			case zk.EventNodeDataChanged, zk.EventNodeCreated, zk.EventNotWatching:
+			// loop, data is read again and a change in weight or availability is reported
 			case zk.EventNodeDeleted:
 				logs.WithF(fields).Debug("Node deleted")
-				w.reports.removeNode(node)
+				w.removeAfterGrace(node, func() { w.reports.removeNode(node) })
 				return
 			}
 		case <-stop:
@@ -171,11 +337,75 @@ func (w *WatcherZookeeper) watchNode(node string, stop <-chan struct{}, doneWait
 	}
 }
 
-func isStopped(stop <-chan struct{}) bool {
+// remove servers once the grace is over, unless their node comes back meanwhile. Deleting a root deletes its children first,
+// so admin operations on the path go through node removals. Keys are a node, or a root path with a trailing slash
+func (w *WatcherZookeeper) removeAfterGrace(key string, remove func()) {
+	if w.RootDeleteGraceInMilli <= 0 {
+		remove()
+		return
+	}
+	w.removalsMutex.Lock()
+	defer w.removalsMutex.Unlock()
+	if _, ok := w.pendingRemovals[key]; ok {
+		return
+	}
+	logs.WithF(w.fields.WithField("node", key).WithField("grace", w.RootDeleteGraceInMilli)).Debug("Node deleted. Waiting for it to come back before removing servers")
+	var timer *time.Timer
+	w.removals.Add(1)
+	timer = time.AfterFunc(time.Duration(w.RootDeleteGraceInMilli)*time.Millisecond, func() {
+		defer w.removals.Done()
+		w.removalsMutex.Lock()
+		if w.pendingRemovals[key] != timer {
+			w.removalsMutex.Unlock()
+			return
+		}
+		delete(w.pendingRemovals, key)
+		w.removalsMutex.Unlock()
+		remove()
+	})
+	w.pendingRemovals[key] = timer
+}
+
+func (w *WatcherZookeeper) cancelRemoval(key string) {
+	w.removalsMutex.Lock()
+	defer w.removalsMutex.Unlock()
+	if timer, ok := w.pendingRemovals[key]; ok {
+		if timer.Stop() {
+			w.removals.Done()
+		}
+		delete(w.pendingRemovals, key)
+		logs.WithF(w.fields.WithField("node", key)).Info("Node back within grace. Keeping servers")
+	}
+}
+
+func (w *WatcherZookeeper) cancelAllRemovals() {
+	w.removalsMutex.Lock()
+	defer w.removalsMutex.Unlock()
+	for key, timer := range w.pendingRemovals {
+		if timer.Stop() {
+			w.removals.Done()
+		}
+		delete(w.pendingRemovals, key)
+	}
+}
+
+// exponential backoff capped to max, with jitter so synapses do not retry all at the same time
+func (w *WatcherZookeeper) retryBackoff(failures int) time.Duration {
+	backoff := time.Duration(w.RetryMaxBackoffInMilli) * time.Millisecond
+	if failures < 20 {
+		backoff = time.Duration(w.RetryMinBackoffInMilli<<uint(failures)) * time.Millisecond
+		if max := time.Duration(w.RetryMaxBackoffInMilli) * time.Millisecond; backoff > max {
+			backoff = max
+		}
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func waitOrStop(duration time.Duration, stop <-chan struct{}) bool {
 	select {
-	case <-stop:
+	case <-time.After(duration):
 		return true
-	default:
+	case <-stop:
+		return false
 	}
-	return false
 }
@@ -0,0 +1,370 @@
+package synapse
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// self signed certificate for 127.0.0.1, written as cert.pem and key.pem in dir
+func writeTestCertificate(t *testing.T, dir string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "zookeeper"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %s", err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(dir+"/cert.pem", certPem, 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(dir+"/key.pem", keyPem, 0600); err != nil {
+		t.Fatalf("Failed to write key: %s", err)
+	}
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %s", err)
+	}
+	return certificate
+}
+
+// tls server requiring a client certificate, counting handshakes. Connections are closed right after, so clients reconnect
+func testTlsServer(t *testing.T, certificate tls.Certificate, handshakes *int32) (net.Listener, string) {
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.Leaf)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if err := conn.(*tls.Conn).Handshake(); err == nil {
+				atomic.AddInt32(handshakes, 1)
+			}
+			conn.Close()
+		}
+	}()
+	return listener, listener.Addr().String()
+}
+
+func TestZookeeperTls(t *testing.T) {
+	tests := []struct {
+		name       string
+		tls        string
+		err        bool
+		handshakes int32
+	}{
+		{name: "missing ca file", tls: `{"caFile":"DIR/missing.pem"}`, err: true},
+		{name: "cert without key", tls: `{"caFile":"DIR/cert.pem","certFile":"DIR/cert.pem"}`, err: true},
+		{name: "invalid key", tls: `{"caFile":"DIR/cert.pem","certFile":"DIR/cert.pem","keyFile":"DIR/cert.pem"}`, err: true},
+		{name: "connects and reconnects with tls", tls: `{"caFile":"DIR/cert.pem","certFile":"DIR/cert.pem","keyFile":"DIR/key.pem"}`, handshakes: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			certificate := writeTestCertificate(t, dir)
+			certificate.Leaf, _ = x509.ParseCertificate(certificate.Certificate[0])
+			var handshakes int32
+			listener1, host1 := testTlsServer(t, certificate, &handshakes)
+			defer listener1.Close()
+			listener2, host2 := testTlsServer(t, certificate, &handshakes)
+			defer listener2.Close()
+
+			router, err := RouterFromJson([]byte(`{"type":"console","services":[{"watcher":{"type":"zookeeper",
+				"hosts":["`+host1+`","`+host2+`"],"path":"/services/api",
+				"tls":`+strings.Replace(test.tls, "DIR", dir, -1)+`}}]}`), newTestSynapse())
+			if (err != nil) != test.err {
+				t.Fatalf("Expected error %t, got %v", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+			defer router.getCommon().Services[0].close()
+
+			for deadline := time.Now().Add(2 * time.Second); atomic.LoadInt32(&handshakes) < test.handshakes && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if count := atomic.LoadInt32(&handshakes); count < test.handshakes {
+				t.Errorf("Expected at least %d tls handshakes, got %d", test.handshakes, count)
+			}
+		})
+	}
+}
+
+// zookeeper watcher configuration of /services/api on the test server, with extra options ending with a comma
+func testZkWatcher(zk *testZk, options string) string {
+	return `{"type":"zookeeper",` + options + `"hosts":["` + zk.address() + `"],"path":"/services/api",
+		"retryMinBackoffInMilli":10,"retryMaxBackoffInMilli":10}`
+}
+
+// run the watcher of the service, returning its reports and a function stopping it
+func startTestWatcher(service *Service) (<-chan ServiceReport, func()) {
+	events := make(chan ServiceReport, 1000)
+	context := newContext(false)
+	context.doneWaiter.Add(1)
+	go func() {
+		defer context.doneWaiter.Done()
+		service.typedWatcher.Watch(context, events, service)
+	}()
+	return events, func() {
+		close(context.stop)
+		context.doneWaiter.Wait()
+	}
+}
+
+// wait for a report with exactly the expected server names, returning names of the last report received
+func waitTestServers(events <-chan ServiceReport, expected []string, timeout time.Duration) []string {
+	sort.Strings(expected)
+	names := []string{}
+	deadline := time.After(timeout)
+	for {
+		select {
+		case report := <-events:
+			names = []string{}
+			for _, server := range report.Reports {
+				names = append(names, server.Name)
+			}
+			sort.Strings(names)
+			if strings.Join(names, ",") == strings.Join(expected, ",") {
+				return names
+			}
+		case <-deadline:
+			return names
+		}
+	}
+}
+
+func testZkServer(index int) (string, string) {
+	name := fmt.Sprintf("api%04d", index)
+	return name, fmt.Sprintf(`{"name":"%s","host":"10.0.%d.%d","port":80}`, name, index/256, index%256)
+}
+
+func TestZookeeperManyNodesWithBoundedReads(t *testing.T) {
+	zk := newTestZk(t)
+	defer zk.close()
+	zk.readDelay = 2 * time.Millisecond
+	expected := []string{}
+	for i := 0; i < 1000; i++ {
+		name, content := testZkServer(i)
+		zk.set("/services/api/"+name, content)
+		if i >= 300 {
+			expected = append(expected, name)
+		}
+	}
+
+	router := newTestRouter(t, newTestSynapse(), `{"type":"console","services":[{"name":"api","watcher":`+testZkWatcher(zk, `"maxConcurrentNodeReads":10,`)+`}]}`)
+	events, stop := startTestWatcher(router.getCommon().Services[0])
+	defer stop()
+
+	// changes while nodes are still being read
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 300; i++ {
+		name, _ := testZkServer(i)
+		zk.delete("/services/api/" + name)
+	}
+	for i := 1000; i < 1100; i++ {
+		name, content := testZkServer(i)
+		zk.set("/services/api/"+name, content)
+		expected = append(expected, name)
+	}
+
+	if names := waitTestServers(events, expected, 20*time.Second); len(names) != len(expected) {
+		t.Fatalf("Expected %d servers, got %d", len(expected), len(names))
+	}
+	if reads := zk.maxReadsInFlight(); reads > 10 || reads == 0 {
+		t.Errorf("Expected at most 10 node reads in flight, got %d", reads)
+	}
+}
+
+func TestZookeeperDataChangeAppliedBySocket(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	zk := newTestZk(t)
+	defer zk.close()
+	listener, commands := testSocket(t, "unix", dir+"/haproxy.sock")
+	defer listener.Close()
+	zk.set("/services/api/api1", `{"name":"api1","host":"10.0.0.1","port":80,"available":true,"weight":100}`)
+	zk.set("/services/api/api2", `{"name":"api2","host":"10.0.0.2","port":80,"available":true,"weight":100}`)
+
+	router := newTestRouter(t, newTestSynapse(), `{"type":"haproxy","configPath":"`+dir+`/haproxy.cfg",
+		"reloadCommand":["sh","-c","echo >> `+dir+`/reloads"],"reloadMinIntervalInMilli":1,"socketAddress":"`+dir+`/haproxy.sock",
+		"services":[{"name":"api","watcher":`+testZkWatcher(zk, `"initialReportDelayInMilli":100,`)+`}]}`).(*RouterHaProxy)
+	common := router.getCommon()
+	events, stop := startTestWatcher(common.Services[0])
+	defer stop()
+	backend := "api_" + strconv.Itoa(common.Services[0].id) + "/api1"
+
+	steps := []struct {
+		name    string
+		content string
+		command string
+	}{
+		{name: "initial servers"},
+		{name: "weight change", content: `{"name":"api1","host":"10.0.0.1","port":80,"available":true,"weight":50}`, command: "set weight " + backend + " 50"},
+		{name: "maintenance", content: `{"name":"api1","host":"10.0.0.1","port":80,"available":false,"unavailable_reason":"maintenance"}`, command: "set weight " + backend + " 0"},
+		{name: "back from maintenance", content: `{"name":"api1","host":"10.0.0.1","port":80,"available":true,"weight":100}`, command: "set weight " + backend + " 100"},
+	}
+	for _, step := range steps {
+		if step.content != "" {
+			zk.set("/services/api/api1", step.content)
+		}
+		select {
+		case report := <-events:
+			if err := common.handleReport([]ServiceReport{report}, router); err != nil {
+				t.Fatalf("%s: failed to apply report: %s", step.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no report from watcher", step.name)
+		}
+
+		received := []string{}
+		for len(commands) > 0 {
+			for _, command := range strings.Split(<-commands, "; ") {
+				if strings.Contains(command, "/api1 ") {
+					received = append(received, command)
+				}
+			}
+		}
+		if strings.Join(received, ",") != step.command {
+			t.Errorf("%s: expected socket command '%s', got '%s'", step.name, step.command, strings.Join(received, ","))
+		}
+	}
+	if reloads := strings.Count(readTestFile(t, dir+"/reloads"), "\n"); reloads != 1 {
+		t.Errorf("Expected only the initial servers to reload, got %d reloads", reloads)
+	}
+}
+
+func TestZookeeperDeleteGrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		grace    int
+		recreate bool
+		expected int // servers once changes are applied
+	}{
+		{name: "no grace removes at once", expected: 0},
+		{name: "deleted then recreated within grace", grace: 500, recreate: true, expected: 2},
+		{name: "deleted for longer than grace", grace: 200, expected: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			zk := newTestZk(t)
+			defer zk.close()
+			for i := 1; i <= 2; i++ {
+				name, content := testZkServer(i)
+				zk.set("/services/api/"+name, content)
+			}
+			router := newTestRouter(t, newTestSynapse(), `{"type":"console","services":[{"name":"api","watcher":`+
+				testZkWatcher(zk, `"initialReportDelayInMilli":100,"rootDeleteGraceInMilli":`+strconv.Itoa(test.grace)+`,`)+`}]}`)
+			events, stop := startTestWatcher(router.getCommon().Services[0])
+			defer stop()
+			if report := <-events; len(report.Reports) != 2 {
+				t.Fatalf("Expected 2 servers at start, got %d", len(report.Reports))
+			}
+
+			// children go first, zookeeper does not delete a node with children
+			deleted := time.Now()
+			for i := 1; i <= 2; i++ {
+				name, _ := testZkServer(i)
+				zk.delete("/services/api/" + name)
+			}
+			zk.delete("/services/api")
+			time.Sleep(50 * time.Millisecond)
+			if test.recreate {
+				for i := 1; i <= 2; i++ {
+					name, content := testZkServer(i)
+					zk.set("/services/api/"+name, content)
+				}
+			}
+
+			servers := 2
+			timeout := time.After(time.Duration(test.grace)*time.Millisecond + 500*time.Millisecond)
+			for done := false; !done; {
+				select {
+				case report := <-events:
+					servers = len(report.Reports)
+					if servers < 2 && time.Since(deleted) < time.Duration(test.grace)*time.Millisecond {
+						t.Fatalf("Expected servers kept during grace, got %d", servers)
+					}
+				case <-timeout:
+					done = true
+				}
+			}
+			if servers != test.expected {
+				t.Errorf("Expected %d servers, got %d", test.expected, servers)
+			}
+		})
+	}
+}
+
+func TestZookeeperStopWaitsForRunningRemoval(t *testing.T) {
+	zk := newTestZk(t)
+	defer zk.close()
+	name, content := testZkServer(1)
+	zk.set("/services/api/"+name, content)
+	router := newTestRouter(t, newTestSynapse(), `{"type":"console","services":[{"name":"api","watcher":`+
+		testZkWatcher(zk, `"rootDeleteGraceInMilli":10,`)+`}]}`)
+	service := router.getCommon().Services[0]
+	watcher := service.typedWatcher.(*WatcherZookeeper)
+	events, stop := startTestWatcher(service)
+	<-events
+
+	started := make(chan struct{})
+	removed := make(chan struct{})
+	watcher.removeAfterGrace("/services/other/", func() {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		watcher.reports.removePrefix("/services/other/")
+		close(removed)
+	})
+	<-started
+	stop()
+	select {
+	case <-removed:
+	default:
+		t.Errorf("Expected watcher stop to wait for the running removal")
+	}
+}
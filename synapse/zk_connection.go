@@ -0,0 +1,95 @@
+package synapse
+
+import (
+	"github.com/blablacar/go-nerve/nerve"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/samuel/go-zookeeper/zk"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var zkConnectionsMutex sync.Mutex
+var zkConnections = make(map[string]*zkConnection)
+
+// connection shared by watchers of the same hosts, closed when the last one releases it
+type zkConnection struct {
+	conn   *zk.Conn
+	key    string
+	users  int
+	closed bool
+}
+
+// the logger is read by the connection loop, so it must be set before zk.Connect starts it
+func withZkLogger(c *zk.Conn) {
+	c.SetLogger(nerve.ZKLogger{})
+}
+
+func acquireZkConnection(hosts []string, timeout time.Duration) (*zkConnection, error) {
+	zkConnectionsMutex.Lock()
+	defer zkConnectionsMutex.Unlock()
+
+	sorted := make([]string, len(hosts))
+	copy(sorted, hosts)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, ",")
+	if connection, ok := zkConnections[key]; ok {
+		connection.users++
+		return connection, nil
+	}
+
+	conn, events, err := zk.Connect(sorted, timeout, withZkLogger)
+	if err != nil {
+		return nil, err
+	}
+	connection := &zkConnection{conn: conn, key: key, users: 1}
+	zkConnections[key] = connection
+	go connection.logSession(hosts, events)
+	return connection, nil
+}
+
+func releaseZkConnection(connection *zkConnection) {
+	zkConnectionsMutex.Lock()
+	defer zkConnectionsMutex.Unlock()
+
+	connection.users--
+	if connection.users > 0 {
+		return
+	}
+	delete(zkConnections, connection.key)
+	connection.closed = true
+	connection.conn.Close()
+}
+
+func (c *zkConnection) isClosed() bool {
+	zkConnectionsMutex.Lock()
+	defer zkConnectionsMutex.Unlock()
+	return c.closed
+}
+
+// returns once the connection is closed
+func (c *zkConnection) logSession(hosts []string, events <-chan zk.Event) {
+	fields := data.WithField("servers", hosts)
+	connected := false
+	for e := range events {
+		if e.Type != zk.EventSession {
+			continue
+		}
+		switch e.State {
+		case zk.StateHasSession:
+			if !connected {
+				logs.WithF(fields).Info("Connected to zk")
+			}
+			connected = true
+		case zk.StateDisconnected, zk.StateExpired:
+			if connected && !c.isClosed() {
+				logs.WithF(fields).Warn("Connection lost to zk")
+			}
+			connected = false
+		case zk.StateAuthFailed:
+			logs.WithF(fields).Error("Authentication failure on zk")
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package synapse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestZkConnectionSharedUntilLastRelease(t *testing.T) {
+	first, err := acquireZkConnection([]string{"127.0.0.1:1", "127.0.0.2:1"}, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	second, err := acquireZkConnection([]string{"127.0.0.2:1", "127.0.0.1:1"}, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	if first != second {
+		t.Fatalf("Expected watchers of the same hosts to share the connection")
+	}
+
+	releaseZkConnection(first)
+	zkConnectionsMutex.Lock()
+	_, ok := zkConnections[first.key]
+	zkConnectionsMutex.Unlock()
+	if !ok || first.isClosed() {
+		t.Fatalf("Expected connection to stay open while still used")
+	}
+
+	releaseZkConnection(second)
+	zkConnectionsMutex.Lock()
+	_, ok = zkConnections[first.key]
+	zkConnectionsMutex.Unlock()
+	if ok || !first.isClosed() {
+		t.Errorf("Expected connection to be closed after last release")
+	}
+}
@@ -0,0 +1,337 @@
+package synapse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in memory zookeeper speaking the client protocol for getChildren2, getData, exists and ping.
+// Watches are one shot, like on a real server
+type testZk struct {
+	sync.Mutex
+	listener     net.Listener
+	nodes        map[string][]byte
+	mtimes       map[string]int64
+	zxid         int64
+	conns        []*testZkConn
+	readDelay    time.Duration
+	readsRunning int
+	maxReads     int
+}
+
+type testZkConn struct {
+	writeMutex    sync.Mutex
+	conn          net.Conn
+	dataWatches   map[string]struct{}
+	childWatches  map[string]struct{}
+	existsWatches map[string]struct{}
+}
+
+const (
+	testZkOpExists       = 3
+	testZkOpGetData      = 4
+	testZkOpPing         = 11
+	testZkOpGetChildren2 = 12
+	testZkOpClose        = -11
+	testZkErrNoNode      = -101
+
+	testZkEventCreated         = 1
+	testZkEventDeleted         = 2
+	testZkEventDataChanged     = 3
+	testZkEventChildrenChanged = 4
+)
+
+func newTestZk(t *testing.T) *testZk {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	z := &testZk{
+		listener: listener,
+		nodes:    map[string][]byte{"/": nil},
+		mtimes:   make(map[string]int64),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go z.serve(conn)
+		}
+	}()
+	return z
+}
+
+func (z *testZk) address() string {
+	return z.listener.Addr().String()
+}
+
+func (z *testZk) close() {
+	z.listener.Close()
+	z.Lock()
+	defer z.Unlock()
+	for _, c := range z.conns {
+		c.conn.Close()
+	}
+}
+
+// create or update a node, parents are created
+func (z *testZk) set(path string, content string) {
+	z.Lock()
+	defer z.Unlock()
+	if parent := testZkParent(path); parent != "/" {
+		if _, ok := z.nodes[parent]; !ok {
+			z.nodes[parent] = nil
+			z.notify(parent, testZkEventCreated)
+		}
+	}
+	_, exists := z.nodes[path]
+	z.nodes[path] = []byte(content)
+	z.zxid++
+	z.mtimes[path] = z.zxid
+	if exists {
+		z.notify(path, testZkEventDataChanged)
+	} else {
+		z.notify(path, testZkEventCreated)
+	}
+}
+
+func (z *testZk) delete(path string) {
+	z.Lock()
+	defer z.Unlock()
+	if _, ok := z.nodes[path]; !ok {
+		return
+	}
+	delete(z.nodes, path)
+	z.zxid++
+	z.notify(path, testZkEventDeleted)
+}
+
+// send event to watchers of path, and children changed to watchers of parent on create and delete
+func (z *testZk) notify(path string, eventType int32) {
+	for _, c := range z.conns {
+		switch eventType {
+		case testZkEventCreated:
+			c.fire(path, eventType, c.existsWatches)
+		case testZkEventDataChanged:
+			c.fire(path, eventType, c.existsWatches, c.dataWatches)
+		case testZkEventDeleted:
+			c.fire(path, eventType, c.existsWatches, c.dataWatches, c.childWatches)
+		}
+		if eventType != testZkEventDataChanged {
+			c.fire(testZkParent(path), testZkEventChildrenChanged, c.childWatches)
+		}
+	}
+}
+
+func (c *testZkConn) fire(path string, eventType int32, watches ...map[string]struct{}) {
+	fired := false
+	for _, w := range watches {
+		if _, ok := w[path]; ok {
+			delete(w, path)
+			fired = true
+		}
+	}
+	if fired {
+		var b bytes.Buffer
+		testZkWrite(&b, int32(-1), int64(-1), int32(0), eventType, int32(3))
+		testZkWriteString(&b, path)
+		c.send(b.Bytes())
+	}
+}
+
+func (z *testZk) children(path string) []string {
+	children := []string{}
+	for node := range z.nodes {
+		if node != "/" && testZkParent(node) == path {
+			children = append(children, node[strings.LastIndex(node, "/")+1:])
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func testZkParent(path string) string {
+	if i := strings.LastIndex(path, "/"); i > 0 {
+		return path[:i]
+	}
+	return "/"
+}
+
+func (z *testZk) serve(conn net.Conn) {
+	c := &testZkConn{
+		conn:          conn,
+		dataWatches:   make(map[string]struct{}),
+		childWatches:  make(map[string]struct{}),
+		existsWatches: make(map[string]struct{}),
+	}
+	if _, err := testZkRead(conn); err != nil {
+		conn.Close()
+		return
+	}
+	var b bytes.Buffer
+	testZkWrite(&b, int32(0), int32(30000), int64(1))
+	testZkWriteBytes(&b, make([]byte, 16))
+	c.send(b.Bytes())
+
+	z.Lock()
+	z.conns = append(z.conns, c)
+	z.Unlock()
+
+	for {
+		packet, err := testZkRead(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		reader := bytes.NewReader(packet)
+		var xid, opcode int32
+		testZkReadValues(reader, &xid, &opcode)
+		switch opcode {
+		case testZkOpPing:
+			c.reply(xid, 0, z.zxid, nil)
+		case testZkOpClose:
+			c.reply(xid, 0, z.zxid, nil)
+			conn.Close()
+			return
+		case testZkOpGetData:
+			path, watch := testZkReadPathWatch(reader)
+			go z.getData(c, xid, path, watch)
+		case testZkOpGetChildren2, testZkOpExists:
+			path, watch := testZkReadPathWatch(reader)
+			z.Lock()
+			_, exists := z.nodes[path]
+			var body bytes.Buffer
+			errCode := int32(0)
+			if opcode == testZkOpExists {
+				if watch {
+					c.existsWatches[path] = struct{}{}
+				}
+				if !exists {
+					errCode = testZkErrNoNode
+				}
+				testZkWriteStat(&body, z.mtimes[path], len(z.nodes[path]))
+			} else if !exists {
+				errCode = testZkErrNoNode
+			} else {
+				if watch {
+					c.childWatches[path] = struct{}{}
+				}
+				children := z.children(path)
+				testZkWrite(&body, int32(len(children)))
+				for _, child := range children {
+					testZkWriteString(&body, child)
+				}
+				testZkWriteStat(&body, z.mtimes[path], 0)
+			}
+			c.reply(xid, errCode, z.zxid, body.Bytes())
+			z.Unlock()
+		default:
+			c.reply(xid, 0, z.zxid, nil)
+		}
+	}
+}
+
+// answered after readDelay, counting reads in flight
+func (z *testZk) getData(c *testZkConn, xid int32, path string, watch bool) {
+	z.Lock()
+	z.readsRunning++
+	if z.readsRunning > z.maxReads {
+		z.maxReads = z.readsRunning
+	}
+	delay := z.readDelay
+	z.Unlock()
+	time.Sleep(delay)
+
+	z.Lock()
+	defer z.Unlock()
+	z.readsRunning--
+	content, exists := z.nodes[path]
+	if !exists {
+		c.reply(xid, testZkErrNoNode, z.zxid, nil)
+		return
+	}
+	if watch {
+		c.dataWatches[path] = struct{}{}
+	}
+	var body bytes.Buffer
+	testZkWriteBytes(&body, content)
+	testZkWriteStat(&body, z.mtimes[path], len(content))
+	c.reply(xid, 0, z.zxid, body.Bytes())
+}
+
+func (z *testZk) maxReadsInFlight() int {
+	z.Lock()
+	defer z.Unlock()
+	return z.maxReads
+}
+
+func (c *testZkConn) reply(xid int32, errCode int32, zxid int64, body []byte) {
+	var b bytes.Buffer
+	testZkWrite(&b, xid, zxid, errCode)
+	if errCode == 0 {
+		b.Write(body)
+	}
+	c.send(b.Bytes())
+}
+
+func (c *testZkConn) send(packet []byte) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	binary.Write(c.conn, binary.BigEndian, int32(len(packet)))
+	c.conn.Write(packet)
+}
+
+func testZkRead(conn net.Conn) ([]byte, error) {
+	var length int32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, length)
+	_, err := io.ReadFull(conn, packet)
+	return packet, err
+}
+
+func testZkReadValues(reader io.Reader, values ...interface{}) {
+	for _, value := range values {
+		binary.Read(reader, binary.BigEndian, value)
+	}
+}
+
+func testZkReadPathWatch(reader io.Reader) (string, bool) {
+	var length int32
+	testZkReadValues(reader, &length)
+	path := make([]byte, length)
+	io.ReadFull(reader, path)
+	var watch bool
+	testZkReadValues(reader, &watch)
+	return string(path), watch
+}
+
+func testZkWrite(b *bytes.Buffer, values ...interface{}) {
+	for _, value := range values {
+		binary.Write(b, binary.BigEndian, value)
+	}
+}
+
+func testZkWriteString(b *bytes.Buffer, value string) {
+	testZkWriteBytes(b, []byte(value))
+}
+
+func testZkWriteBytes(b *bytes.Buffer, value []byte) {
+	testZkWrite(b, int32(len(value)))
+	b.Write(value)
+}
+
+// czxid, mzxid, ctime, mtime, version, cversion, aversion, ephemeralOwner, dataLength, numChildren, pzxid
+func testZkWriteStat(b *bytes.Buffer, mtime int64, dataLength int) {
+	testZkWrite(b, mtime, mtime, mtime, mtime, int32(0), int32(0), int32(0), int64(0), int32(dataLength), int32(0), mtime)
+}